@@ -0,0 +1,219 @@
+// Package classifier assigns a category to nixpkgs-update logs, based on rules
+// matching their lines.
+package classifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// Category is the outcome of a log.
+type Category string
+
+const (
+	// A nix build or evaluation error.
+	BuildError Category = "build-error"
+	// A fixed-output derivation with the wrong hash.
+	HashMismatch Category = "hash-mismatch"
+	// nixpkgs-update or the package's update script failed.
+	UpdateScriptFailure Category = "update-script-failure"
+	// nixpkgs-update decided not to update the package.
+	NoUpdate Category = "no-update"
+	// No rule matched.
+	Success Category = "success"
+)
+
+var descriptions = map[Category]string{
+	BuildError:          "build error",
+	HashMismatch:        "hash mismatch",
+	UpdateScriptFailure: "update script failure",
+	NoUpdate:            "skipped update",
+	Success:             "success",
+}
+
+// Failed returns whether logs in this category should be reported as failures.
+func (c Category) Failed() bool {
+	return c == BuildError || c == HashMismatch || c == UpdateScriptFailure
+}
+
+// Description returns a human-readable description of the category.
+func (c Category) Description() string {
+	if d, ok := descriptions[c]; ok {
+		return d
+	}
+
+	return string(c)
+}
+
+// Rule assigns Category to logs containing a line matching Pattern.
+type Rule struct {
+	Name     string   `json:"name"`
+	Category Category `json:"category"`
+	Pattern  string   `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// The rules used when no rules file is given.
+// - "error: " is a nix build error
+// - "ExitFailure" is a nixpkgs-update error
+// - "failed with" is a nixpkgs/maintainers/scripts/update.py error
+var defaultRules = []Rule{
+	{Name: "hash-mismatch", Category: HashMismatch, Pattern: `^error: hash mismatch in fixed-output derivation`},
+	{Name: "nix-error", Category: BuildError, Pattern: `^error:`},
+	{Name: "update-script", Category: UpdateScriptFailure, Pattern: `failed with`},
+	{Name: "exit-failure", Category: UpdateScriptFailure, Pattern: `ExitFailure`},
+	{Name: "no-update", Category: NoUpdate, Pattern: `(?i)\bno updates? (?:found|available)\b|^skipping\b`},
+}
+
+// Classifier categorizes logs using an ordered list of rules.
+type Classifier struct {
+	rules []Rule
+}
+
+// New compiles rules into a Classifier.
+//
+// Rules are in order of precedence: a log gets the category of the first rule
+// matching any of its lines.
+func New(rules []Rule) (*Classifier, error) {
+	c := &Classifier{rules: make([]Rule, len(rules))}
+
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d: missing name", i)
+		}
+		if _, ok := descriptions[r.Category]; !ok || r.Category == Success {
+			return nil, fmt.Errorf("rule %s: invalid category %q", r.Name, r.Category)
+		}
+
+		if r.Pattern == "" {
+			return nil, fmt.Errorf("rule %s: missing pattern", r.Name)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+
+		r.re = re
+		c.rules[i] = r
+	}
+
+	return c, nil
+}
+
+// Load reads rules from a JSON file, e.g.:
+//
+//	[{"name": "nix-error", "category": "build-error", "pattern": "^error:"}]
+func Load(path string) (*Classifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	return New(rules)
+}
+
+// Default returns a Classifier using the built-in rules.
+func Default() *Classifier {
+	c, err := New(defaultRules)
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// Match is a line matched by a rule.
+type Match struct {
+	// 0-based line number
+	Line int
+	Text string
+	Rule string
+}
+
+// Result is the classification of a log.
+type Result struct {
+	Category Category
+	// Name of the rule that decided Category, if any.
+	Rule string
+	// Lines matched by rules for failure categories, at most maxMatches.
+	Matches []Match
+}
+
+// Maximum number of matches kept in a Result.
+const maxMatches = 20
+
+// Classify categorizes a log, given its lines.
+func (c *Classifier) Classify(lines []string) Result {
+	s := c.NewScanner()
+	for _, line := range lines {
+		s.Line(line)
+	}
+
+	return s.Result()
+}
+
+// Scanner classifies a log line by line, e.g. while it's being downloaded.
+type Scanner struct {
+	c   *Classifier
+	res Result
+	// number of lines seen so far
+	lines int
+	// index of the rule that decided the category so far
+	best int
+}
+
+// NewScanner returns a Scanner for a new log.
+func (c *Classifier) NewScanner() *Scanner {
+	return &Scanner{
+		c:    c,
+		res:  Result{Category: Success},
+		best: len(c.rules),
+	}
+}
+
+// Line feeds the next line of the log to the scanner, and returns whether it
+// was added to the result's matches.
+func (s *Scanner) Line(line string) (matched bool) {
+	n := s.lines
+	s.lines++
+
+	for j, r := range s.c.rules {
+		if !r.re.MatchString(line) {
+			continue
+		}
+
+		if j < s.best {
+			s.best = j
+			s.res.Category = r.Category
+			s.res.Rule = r.Name
+		}
+		if r.Category.Failed() && len(s.res.Matches) < maxMatches {
+			s.res.Matches = append(s.res.Matches, Match{Line: n, Text: line, Rule: r.Name})
+			matched = true
+		}
+
+		// a line is only matched by its first rule
+		break
+	}
+
+	return matched
+}
+
+// Certain returns whether the category can't change anymore, no matter what
+// lines follow, i.e. the highest-precedence rule has matched.
+func (s *Scanner) Certain() bool {
+	return s.best == 0
+}
+
+// Result returns the classification of the lines seen so far.
+func (s *Scanner) Result() Result {
+	return s.res
+}
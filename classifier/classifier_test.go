@@ -0,0 +1,186 @@
+package classifier
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultRules(t *testing.T) {
+	c := Default()
+
+	positives := []struct {
+		line     string
+		category Category
+	}{
+		// https://nixpkgs-update-logs.nix-community.org/grafana-dash-n-grab/2024-09-13.log
+		{"error: attribute 'originalSrc' in selection path 'grafana-dash-n-grab.originalSrc' not found", BuildError},
+		// https://nixpkgs-update-logs.nix-community.org/babashka/2024-09-13.log
+		{"Received ExitFailure 1 when running", UpdateScriptFailure},
+		// https://nixpkgs-update-logs.nix-community.org/php83Extensions.ssh2/2024-09-19.log
+		{"The update script for php-ssh2-1.3.1 failed with exit code 1", UpdateScriptFailure},
+		// https://nixpkgs-update-logs.nix-community.org/kyverno-chainsaw/2024-09-19.log
+		{"error: builder for '/nix/store/gxvr06ifbpw342msbqbjd89fv8572kdr-kyverno-chainsaw-0.2.10-go-modules.drv' failed with exit code 1;", BuildError},
+		{"error: hash mismatch in fixed-output derivation '/nix/store/0k5ncbiwhn2fcnl7h7ss5wp5jqvbwyyf-source.drv':", HashMismatch},
+	}
+	for _, p := range positives {
+		res := c.Classify([]string{p.line})
+		if res.Category != p.category {
+			t.Errorf("%s: expected %s, got %s", p.line, p.category, res.Category)
+		}
+		if len(res.Matches) != 1 {
+			t.Errorf("%s: expected a match, got %v", p.line, res.Matches)
+		}
+	}
+
+	falsePositives := []string{
+		// https://nixpkgs-update-logs.nix-community.org/glibc/2024-08-05.log
+		`"configure: error: Pthreads are required to build libgomp"`,
+		// https://nixpkgs-update-logs.nix-community.org/rPackages.MBESS/2023-12-24.log
+		`"flock ${xvfb-run} xvfb-run -a -e xvfb-error R"`,
+		// https://nixpkgs-update-logs.nix-community.org/testlib/2024-09-13.log
+		`copying nixpkgs_review/errors.py -> build/lib/nixpkgs_review`,
+	}
+	for _, s := range falsePositives {
+		if res := c.Classify([]string{s}); res.Category != Success {
+			t.Errorf("%s: expected %s, got %s", s, Success, res.Category)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	c := Default()
+
+	lines := []string{
+		"foo 1.0 -> 1.1",
+		"Received ExitFailure 1 when running",
+		"error: hash mismatch in fixed-output derivation '/nix/store/foo.drv':",
+	}
+
+	res := c.Classify(lines)
+	if res.Category != HashMismatch || res.Rule != "hash-mismatch" {
+		t.Errorf("expected %s, got %s (%s)", HashMismatch, res.Category, res.Rule)
+	}
+
+	expected := []Match{
+		{Line: 1, Text: lines[1], Rule: "exit-failure"},
+		{Line: 2, Text: lines[2], Rule: "hash-mismatch"},
+	}
+	if len(res.Matches) != len(expected) {
+		t.Fatalf("expected: %v\ngot: %v", expected, res.Matches)
+	}
+	for i, m := range res.Matches {
+		if m != expected[i] {
+			t.Errorf("expected: %v\ngot: %v", expected[i], m)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("valid", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.json")
+		if err := os.WriteFile(path, []byte(`[{"name": "oops", "category": "build-error", "pattern": "^oops"}]`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res := c.Classify([]string{"oops, I did it again"}); res.Category != BuildError || res.Rule != "oops" {
+			t.Errorf("expected %s, got %s (%s)", BuildError, res.Category, res.Rule)
+		}
+		if res := c.Classify([]string{"error: not a rule anymore"}); res.Category != Success {
+			t.Errorf("expected %s, got %s", Success, res.Category)
+		}
+	})
+
+	for name, rules := range map[string]string{
+		"unknown category": `[{"name": "a", "category": "bogus", "pattern": "a"}]`,
+		"success category": `[{"name": "a", "category": "success", "pattern": "a"}]`,
+		"invalid pattern":  `[{"name": "a", "category": "build-error", "pattern": "("}]`,
+		"missing pattern":  `[{"name": "a", "category": "build-error"}]`,
+		"missing name":     `[{"category": "build-error", "pattern": "a"}]`,
+		"invalid JSON":     `{`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "invalid.json")
+			if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Load(path); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestScannerCertain(t *testing.T) {
+	s := Default().NewScanner()
+
+	if !s.Line("error: builder failed") || s.Certain() {
+		t.Error("a build error could still turn out to be a hash mismatch")
+	}
+	if s.Line("all good") || s.Certain() {
+		t.Error("unmatched lines shouldn't change anything")
+	}
+	if !s.Line("error: hash mismatch in fixed-output derivation '/nix/store/foo.drv':") || !s.Certain() {
+		t.Error("the first rule should make the verdict certain")
+	}
+	if res := s.Result(); res.Category != HashMismatch || len(res.Matches) != 2 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		line, expected string
+	}{
+		{
+			"error: builder for '/nix/store/8p5sf8w5y5yqq5yqmfajkqr93rlyb1xl-foo-1.0.drv' failed with exit code 1",
+			"error: builder for '/nix/store/<hash>-foo-1.0.drv' failed with exit code 1",
+		},
+		{
+			"         got:    sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+			"got:    <hash>",
+		},
+		{
+			"specified: sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+			"specified: <hash>",
+		},
+		{
+			"2024-12-10T08:15:00Z building in /tmp/nix-build-foo-1.0.drv-3",
+			"<time> building in /tmp/nix-build-foo-1.0.drv-<n>",
+		},
+		{
+			"ExitFailure 1",
+			"ExitFailure 1",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := Normalize(tt.line); got != tt.expected {
+			t.Errorf("expected: %q\ngot: %q", tt.expected, got)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := Fingerprint([]string{"error: builder for '/nix/store/8p5sf8w5y5yqq5yqmfajkqr93rlyb1xl-foo-1.0.drv' failed"})
+	b := Fingerprint([]string{"error: builder for '/nix/store/0mdqa9w1p6cmli6976v4wi0sw9r4p5pr-foo-1.0.drv' failed"})
+	c := Fingerprint([]string{"error: builder for '/nix/store/0mdqa9w1p6cmli6976v4wi0sw9r4p5pr-foo-1.1.drv' failed"})
+
+	if a != b {
+		t.Errorf("same failure, different fingerprints: %s, %s", a, b)
+	}
+	if a == c {
+		t.Errorf("different failures, same fingerprint: %s", a)
+	}
+	if f := Fingerprint(nil); f != "" {
+		t.Errorf("expected no fingerprint, got: %s", f)
+	}
+}
@@ -0,0 +1,55 @@
+package classifier
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// Parts of log lines that differ between runs of the same failure, and what
+// they're replaced with.
+var volatile = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// store path hashes, e.g. /nix/store/8p5sf8w5y5yqq5yqmfajkqr93rlyb1xl-foo-1.0
+	{regexp.MustCompile(`/nix/store/[0-9a-z]{32}-`), "/nix/store/<hash>-"},
+	// SRI hashes, e.g. sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+	{regexp.MustCompile(`\b(?:sha1|sha256|sha512)-[A-Za-z0-9+/]+=*`), "<hash>"},
+	// nix base32 and hex hashes
+	{regexp.MustCompile(`\b(?:sha256:)?(?:[0-9a-df-np-sv-z]{52}|[0-9a-f]{32,})\b`), "<hash>"},
+	// timestamps and dates
+	{regexp.MustCompile(`\d{4}-\d{2}-\d{2}(?:[T ]\d{2}:\d{2}(?::\d{2}(?:\.\d+)?)?(?:Z|[+-]\d{2}:?\d{2})?)?`), "<time>"},
+	{regexp.MustCompile(`\b\d{2}:\d{2}:\d{2}(?:\.\d+)?\b`), "<time>"},
+	// temporary build directories, e.g. /tmp/nix-build-foo-1.0.drv-0
+	{regexp.MustCompile(`(nix-build-\S+?\.drv)-\d+`), "$1-<n>"},
+}
+
+// Normalize strips the parts of a log line that change between runs failing
+// in the same way, like hashes, store paths and timestamps.
+func Normalize(line string) string {
+	for _, v := range volatile {
+		line = v.re.ReplaceAllString(line, v.repl)
+	}
+
+	return strings.TrimSpace(line)
+}
+
+// Fingerprint identifies a failure by the lines matched in its log, so that
+// logs failing in the same way get the same fingerprint.
+//
+// It returns "" if there are no lines.
+func Fingerprint(matches []string) string {
+	if len(matches) == 0 {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, m := range matches {
+		h.Write([]byte(Normalize(m)))
+		h.Write([]byte{'\n'})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+)
+
+// All categories, in the order they're shown in the confusion matrix.
+var categories = []classifier.Category{
+	classifier.BuildError,
+	classifier.HashMismatch,
+	classifier.UpdateScriptFailure,
+	classifier.NoUpdate,
+	classifier.Success,
+}
+
+// runClassify implements the classify subcommand, which runs the classifier
+// over a directory of saved logs, e.g.:
+//
+//	nixpkgs-update-notifier -classifier.rules rules.json classify -labels labels.txt logs/
+//
+// The labels file has one "<file name> <category>" pair per line. When given,
+// precision, recall and a confusion matrix are printed after the verdicts.
+func runClassify(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("classify", flag.ContinueOnError)
+	labelsPath := fs.String("labels", "", "File with the expected category of each log")
+	fs.SetOutput(out)
+	fs.Usage = func() {
+		fmt.Fprintln(out, "Usage: nixpkgs-update-notifier [flags] classify [-labels file] <dir>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+
+		return fmt.Errorf("expected a directory, got %d arguments", fs.NArg())
+	}
+	dir := fs.Arg(0)
+
+	var labels map[string]classifier.Category
+	if *labelsPath != "" {
+		var err error
+		if labels, err = readLabels(*labelsPath); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var e evaluation
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tCATEGORY\tRULE\tLABEL\t")
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		l, err := scanFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		label, labelled := labels[entry.Name()]
+
+		verdict := ""
+		if labelled {
+			e.add(label, l.Category)
+			if label != l.Category {
+				verdict = "✗"
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.Name(), l.Category, orDash(l.Rule), orDash(string(label)), verdict)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if labels != nil {
+		fmt.Fprintln(out)
+		e.print(out)
+	}
+
+	return nil
+}
+
+// Parses a labels file, made of "<file name> <category>" lines.
+// Empty lines and lines starting with # are ignored.
+func readLabels(path string) (map[string]classifier.Category, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	labels := make(map[string]classifier.Category)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<file> <category>\"", path, n)
+		}
+
+		c := classifier.Category(fields[1])
+		if !slices.Contains(categories, c) {
+			return nil, fmt.Errorf("%s:%d: unknown category %q", path, n, c)
+		}
+		labels[fields[0]] = c
+	}
+
+	return labels, scanner.Err()
+}
+
+// evaluation compares the classifier's verdicts with labels.
+type evaluation struct {
+	// confusion[label][predicted]
+	confusion map[classifier.Category]map[classifier.Category]int
+}
+
+func (e *evaluation) add(label, predicted classifier.Category) {
+	if e.confusion == nil {
+		e.confusion = make(map[classifier.Category]map[classifier.Category]int)
+	}
+	if e.confusion[label] == nil {
+		e.confusion[label] = make(map[classifier.Category]int)
+	}
+
+	e.confusion[label][predicted]++
+}
+
+// Returns precision and recall of failure detection, i.e. regardless of the
+// specific failure category.
+func (e *evaluation) precisionRecall() (precision, recall float64, tp, fp, fn, tn int) {
+	for label, row := range e.confusion {
+		for predicted, n := range row {
+			switch {
+			case label.Failed() && predicted.Failed():
+				tp += n
+			case !label.Failed() && predicted.Failed():
+				fp += n
+			case label.Failed() && !predicted.Failed():
+				fn += n
+			default:
+				tn += n
+			}
+		}
+	}
+
+	if tp+fp > 0 {
+		precision = float64(tp) / float64(tp+fp)
+	}
+	if tp+fn > 0 {
+		recall = float64(tp) / float64(tp+fn)
+	}
+
+	return
+}
+
+func (e *evaluation) print(out io.Writer) {
+	precision, recall, tp, fp, fn, tn := e.precisionRecall()
+	fmt.Fprintf(out, "Failure detection: precision %.2f, recall %.2f (TP %d, FP %d, FN %d, TN %d)\n\n", precision, recall, tp, fp, fn, tn)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "label \\ predicted\t")
+	for _, c := range categories {
+		fmt.Fprintf(tw, "%s\t", c)
+	}
+	fmt.Fprintln(tw)
+
+	for _, label := range categories {
+		fmt.Fprintf(tw, "%s\t", label)
+		for _, predicted := range categories {
+			fmt.Fprintf(tw, "%d\t", e.confusion[label][predicted])
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func scanFile(path string) (logEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return logEntry{}, err
+	}
+	defer f.Close()
+
+	return scanLog(f)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunClassify(t *testing.T) {
+	dir := t.TempDir()
+	logs := map[string]string{
+		"build.log":   "foo 1.0 -> 1.1\nerror: builder for '/nix/store/foo.drv' failed\n",
+		"hash.log":    "error: hash mismatch in fixed-output derivation '/nix/store/foo.drv':\n",
+		"clean.log":   "foo 1.0 -> 1.1\nhttps://github.com/NixOS/nixpkgs/pull/1\n",
+		"missed.log":  "configure: error: something broke\n",
+		"unknown.log": "nothing to see here\n",
+	}
+	for name, body := range logs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	labels := filepath.Join(t.TempDir(), "labels.txt")
+	if err := os.WriteFile(labels, []byte(`# expected categories
+build.log build-error
+hash.log build-error
+clean.log success
+missed.log build-error
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := runClassify([]string{"-labels", labels, dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"hash.log     hash-mismatch  hash-mismatch  build-error  ✗",
+		"unknown.log  success        -              -",
+		"precision 1.00, recall 0.67 (TP 2, FP 0, FN 1, TN 1)",
+	} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("output should contain %q:\n%s", s, out.String())
+		}
+	}
+}
+
+func TestReadLabelsErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.txt")
+
+	for _, content := range []string{"foo.log", "foo.log bogus-category"} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := readLabels(path); err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+}
@@ -3,12 +3,48 @@ CREATE TABLE IF NOT EXISTS subscriptions (
   roomid TEXT NOT NULL,
   mxid TEXT NOT NULL,
   attr_path TEXT NOT NULL REFERENCES packages(attr_path) ON DELETE CASCADE,
+  -- the rule that added the subscription, if any
+  rule_id INTEGER REFERENCES rules(id) ON DELETE CASCADE,
+  -- notices are suppressed until this time, in UTC
+  muted_until TEXT,
+  -- notices are suppressed until the package builds again
+  muted_until_fixed INTEGER NOT NULL DEFAULT 0,
   UNIQUE (attr_path,mxid,roomid)
 ) STRICT;
 
+-- Follows and glob subscriptions, whose subscriptions are kept up to date as
+-- packages change maintainers or are added.
+CREATE TABLE IF NOT EXISTS rules (
+  id INTEGER PRIMARY KEY,
+  roomid TEXT NOT NULL,
+  mxid TEXT NOT NULL,
+  -- 'maintainer', 'team' or 'glob'
+  kind TEXT NOT NULL,
+  -- GitHub handle or team name (lowercase), or glob pattern
+  value TEXT NOT NULL,
+  -- for teams, whether packages maintained by its members are included
+  members INTEGER NOT NULL DEFAULT 0,
+  created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (roomid, kind, value)
+) STRICT;
+
+-- Packages covered by a rule, that were unsubscribed from with unsub, and
+-- mustn't be subscribed to again by the rule.
+CREATE TABLE IF NOT EXISTS rule_exclusions (
+  rule_id INTEGER NOT NULL REFERENCES rules(id) ON DELETE CASCADE,
+  attr_path TEXT NOT NULL,
+  PRIMARY KEY (rule_id, attr_path)
+) STRICT;
+
 CREATE TABLE IF NOT EXISTS packages (
   attr_path TEXT PRIMARY KEY,
-  last_visited TEXT
+  last_visited TEXT,
+  -- modification time of the package's directory, as shown on the main page
+  last_modified TEXT,
+  -- last_modified as of the package's last successful check
+  checked_modified TEXT,
+  -- when the package is due to be checked again, in UTC
+  next_check TEXT
 ) STRICT;
 
 CREATE TRIGGER IF NOT EXISTS ensure_packages_last_visited_set BEFORE INSERT ON subscriptions
@@ -18,3 +54,102 @@ CREATE TRIGGER IF NOT EXISTS ensure_packages_last_visited_set BEFORE INSERT ON s
         RAISE(ABORT, 'Insert aborted: last_visited is NULL')
       END;
   END;
+
+-- Responses fetched via makeRequest, used to revalidate them with conditional requests.
+CREATE TABLE IF NOT EXISTS http_cache (
+  url TEXT PRIMARY KEY,
+  etag TEXT,
+  last_modified TEXT,
+  body BLOB NOT NULL,
+  fetched_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+) STRICT;
+
+-- Every log checked by updateSubs.
+CREATE TABLE IF NOT EXISTS logs (
+  id INTEGER PRIMARY KEY,
+  attr_path TEXT NOT NULL REFERENCES packages(attr_path) ON DELETE CASCADE,
+  date TEXT NOT NULL,
+  url TEXT NOT NULL,
+  -- 'error' or 'ok'
+  status TEXT NOT NULL,
+  -- see classifier.Category
+  category TEXT,
+  -- name of the classifier rule that decided the category
+  rule TEXT,
+  -- lines matched by the error detector, newline-separated
+  matched TEXT,
+  -- matched lines with surrounding context, as sent in notifications
+  excerpt TEXT,
+  -- parsed by the logparser package
+  old_version TEXT,
+  new_version TEXT,
+  update_url TEXT,
+  pr_url TEXT,
+  outcome TEXT,
+  -- see classifier.Fingerprint
+  fingerprint TEXT,
+  -- whether subscribers were notified about this log's failure
+  notified INTEGER NOT NULL DEFAULT 0,
+  fetched_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (attr_path, date)
+) STRICT;
+
+-- packages.last_visited is the date of the latest log we've seen.
+CREATE TRIGGER IF NOT EXISTS logs_set_last_visited AFTER INSERT ON logs
+  BEGIN
+    UPDATE packages SET last_visited = NEW.date
+      WHERE attr_path = NEW.attr_path AND (last_visited IS NULL OR last_visited < NEW.date);
+  END;
+
+-- Notices a room has opted in to, e.g. 'fixed'.
+CREATE TABLE IF NOT EXISTS opt_ins (
+  roomid TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  PRIMARY KEY (roomid, kind)
+) STRICT;
+
+-- Users' reports of logs that were misclassified.
+CREATE TABLE IF NOT EXISTS feedback (
+  id INTEGER PRIMARY KEY,
+  log_id INTEGER NOT NULL REFERENCES logs(id) ON DELETE CASCADE,
+  roomid TEXT NOT NULL,
+  mxid TEXT NOT NULL,
+  -- 'false-positive' or 'false-negative'
+  label TEXT NOT NULL,
+  created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (log_id, mxid, label)
+) STRICT;
+
+-- Regexes muting notices whose log excerpt they match, per room.
+CREATE TABLE IF NOT EXISTS filters (
+  id INTEGER PRIMARY KEY,
+  roomid TEXT NOT NULL,
+  -- who added the filter
+  mxid TEXT NOT NULL,
+  pattern TEXT NOT NULL,
+  created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (roomid, pattern)
+) STRICT;
+
+-- Rooms receiving failures as a periodic summary, instead of as they happen.
+CREATE TABLE IF NOT EXISTS digests (
+  roomid TEXT PRIMARY KEY,
+  -- 'daily' or 'weekly'
+  period TEXT NOT NULL,
+  -- delivery time, in UTC, as HH:MM
+  at TEXT NOT NULL,
+  -- for weekly digests, the day of the week, from 0 (Sunday)
+  weekday INTEGER NOT NULL DEFAULT 0,
+  -- when the last digest was sent, or the digest was set up, in UTC
+  last_sent TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+) STRICT;
+
+-- Failures waiting to be sent in a room's next digest.
+CREATE TABLE IF NOT EXISTS digest_queue (
+  id INTEGER PRIMARY KEY,
+  roomid TEXT NOT NULL,
+  log_id INTEGER NOT NULL REFERENCES logs(id) ON DELETE CASCADE,
+  -- see noticeKind
+  kind TEXT NOT NULL,
+  UNIQUE (roomid, log_id)
+) STRICT;
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// A digest delivers a room's failures in a single message, once a day or once
+// a week, instead of as they happen.
+type digest struct {
+	roomid string
+	// "daily" or "weekly"
+	period string
+	// delivery time, in UTC, as HH:MM
+	at      string
+	weekday time.Weekday
+	// when the last digest was sent, or the digest was set up
+	lastSent time.Time
+}
+
+func (d digest) String() string {
+	if d.period == "weekly" {
+		return fmt.Sprintf("weekly on %s at %s UTC", d.weekday, d.at)
+	}
+
+	return fmt.Sprintf("daily at %s UTC", d.at)
+}
+
+// Returns when the first digest after t is due.
+func (d digest) next(t time.Time) time.Time {
+	at, err := time.Parse("15:04", d.at)
+	if err != nil {
+		slog.Error("invalid digest time", "roomid", d.roomid, "at", d.at, "err", err)
+	}
+
+	t = t.UTC()
+	next := time.Date(t.Year(), t.Month(), t.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+	if d.period == "weekly" {
+		next = next.AddDate(0, 0, int(d.weekday-next.Weekday()+7)%7)
+	}
+	for !next.After(t) {
+		if d.period == "weekly" {
+			next = next.AddDate(0, 0, 7)
+		} else {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+
+	return next
+}
+
+// Returns the room's digest, and whether it has one.
+func getDigest(ctx context.Context, roomid string) (digest, bool, error) {
+	d := digest{roomid: roomid}
+	var lastSent string
+	err := clients.db.QueryRowContext(ctx, "SELECT period, at, weekday, last_sent FROM digests WHERE roomid = ?", roomid).Scan(&d.period, &d.at, &d.weekday, &lastSent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, false, nil
+	} else if err != nil {
+		return d, false, err
+	}
+
+	d.lastSent, err = time.Parse(time.DateTime, lastSent)
+
+	return d, true, err
+}
+
+// Stores a room's digest. Digests are first sent at the next scheduled time.
+func saveDigest(ctx context.Context, d digest) error {
+	_, err := clients.db.ExecContext(ctx, `
+    INSERT INTO digests(roomid, period, at, weekday) VALUES (?, ?, ?, ?)
+    ON CONFLICT(roomid) DO UPDATE SET period = excluded.period, at = excluded.at, weekday = excluded.weekday, last_sent = CURRENT_TIMESTAMP`,
+		d.roomid, d.period, d.at, d.weekday)
+
+	return err
+}
+
+// Queues a failure for the room's next digest.
+func queueDigest(ctx context.Context, roomid string, f failure) error {
+	_, err := clients.db.ExecContext(ctx, `
+    INSERT OR IGNORE INTO digest_queue(roomid, log_id, kind)
+    SELECT ?, id, ? FROM logs WHERE attr_path = ? AND date = ?`, roomid, f.kind, f.attrPath, f.log.Date)
+
+	return err
+}
+
+// Sends the digests that are due.
+func sendDigests(ctx context.Context) {
+	rows, err := clients.db.QueryContext(ctx, "SELECT roomid FROM digests")
+	if err != nil {
+		fatal(err)
+	}
+	defer rows.Close()
+
+	var roomids []string
+	for rows.Next() {
+		var roomid string
+		if err := rows.Scan(&roomid); err != nil {
+			fatal(err)
+		}
+		roomids = append(roomids, roomid)
+	}
+	if err := rows.Err(); err != nil {
+		fatal(err)
+	}
+
+	now := time.Now().UTC()
+	for _, roomid := range roomids {
+		d, ok, err := getDigest(ctx, roomid)
+		if err != nil {
+			fatal(err)
+		}
+		if !ok || d.next(d.lastSent).After(now) {
+			continue
+		}
+
+		if sent, err := deliverDigest(ctx, roomid, fmt.Sprintf("Your %s digest", d.period)); err != nil {
+			fatal(err)
+		} else if !sent {
+			// retried on the next tick
+			continue
+		}
+		if _, err := clients.db.ExecContext(ctx, "UPDATE digests SET last_sent = ? WHERE roomid = ?", now.Format(time.DateTime), roomid); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// Sends the room's queued failures in a single message, under a title, and
+// empties its queue. Nothing is sent if the queue is empty.
+//
+// It returns false if the digest couldn't be sent, in which case the failures
+// stay queued, to be sent with the next attempt.
+func deliverDigest(ctx context.Context, roomid, title string) (bool, error) {
+	rows, err := clients.db.QueryContext(ctx, `
+    SELECT q.id, q.kind, l.attr_path, l.date, l.category, COALESCE(l.matched, ''), COALESCE(l.excerpt, ''), COALESCE(l.fingerprint, '')
+    FROM digest_queue q JOIN logs l ON l.id = q.log_id
+    WHERE q.roomid = ?
+    ORDER BY q.id`, roomid)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var last int64
+	var failures []failure
+	for rows.Next() {
+		var f failure
+		var matched string
+		if err := rows.Scan(&last, &f.kind, &f.attrPath, &f.log.Date, &f.log.Category, &matched, &f.log.Excerpt, &f.log.Fingerprint); err != nil {
+			return false, err
+		}
+		if matched != "" {
+			f.log.Matches = strings.Split(matched, "\n")
+		}
+		failures = append(failures, f)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if len(failures) == 0 {
+		return true, nil
+	}
+
+	var sections []string
+	for _, group := range groupFailures(failures) {
+		if len(group) == 1 {
+			sections = append(sections, noticeText(group[0].kind, group[0].attrPath, group[0].log))
+		} else {
+			sections = append(sections, clusterText(group))
+		}
+	}
+
+	s := fmt.Sprintf("%s: %d failures", title, len(failures))
+	if len(failures) == 1 {
+		s = fmt.Sprintf("%s: 1 failure", title)
+	}
+
+	slog.Info("sending digest", "roomid", roomid, "failures", len(failures))
+	if err := sendDigest(ctx, roomid, s, sections); err != nil {
+		slog.Error("sending digest, keeping queued failures", "roomid", roomid, "err", err)
+
+		return false, nil
+	}
+
+	_, err = clients.db.ExecContext(ctx, "DELETE FROM digest_queue WHERE roomid = ? AND id <= ?", roomid, last)
+
+	return err == nil, err
+}
+
+// Sends a digest's title and sections in one message or, if that's too large,
+// in one message per section. Sections that are too large on their own are
+// replaced by their first line, e.g. "12 packages failing with the same build
+// error".
+func sendDigest(ctx context.Context, roomid, title string, sections []string) error {
+	_, err := h.sender(ctx, title+"\n\n"+strings.Join(sections, "\n\n"), id.RoomID(roomid))
+	if !errors.Is(err, mautrix.MTooLarge) {
+		return err
+	}
+
+	slog.Warn("digest too large, splitting it", "roomid", roomid, "sections", len(sections))
+	if _, err := h.sender(ctx, title, id.RoomID(roomid)); err != nil {
+		return err
+	}
+	for _, section := range sections {
+		_, err := h.sender(ctx, section, id.RoomID(roomid))
+		if errors.Is(err, mautrix.MTooLarge) {
+			first, _, _ := strings.Cut(section, "\n")
+			_, err = h.sender(ctx, strings.TrimSuffix(first, ":"), id.RoomID(roomid))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
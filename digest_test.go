@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func TestDigestNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2024, 12, 11, 10, 30, 0, 0, time.UTC)
+
+	tt := []struct {
+		d    digest
+		want time.Time
+	}{
+		{digest{period: "daily", at: "11:00"}, time.Date(2024, 12, 11, 11, 0, 0, 0, time.UTC)},
+		{digest{period: "daily", at: "09:00"}, time.Date(2024, 12, 12, 9, 0, 0, 0, time.UTC)},
+		{digest{period: "daily", at: "10:30"}, time.Date(2024, 12, 12, 10, 30, 0, 0, time.UTC)},
+		{digest{period: "weekly", at: "09:00", weekday: time.Monday}, time.Date(2024, 12, 16, 9, 0, 0, 0, time.UTC)},
+		{digest{period: "weekly", at: "11:00", weekday: time.Wednesday}, time.Date(2024, 12, 11, 11, 0, 0, 0, time.UTC)},
+		{digest{period: "weekly", at: "09:00", weekday: time.Wednesday}, time.Date(2024, 12, 18, 9, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range tt {
+		if got := tc.d.next(now); !got.Equal(tc.want) {
+			t.Errorf("%s: expected: %s; got: %s", tc.d, tc.want, got)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	addPackages("foo", "bar", "baz")
+	sub("foo")
+	sub("bar")
+	sub("baz")
+	notify("fixed on")
+
+	sent = nil
+	message("digest")
+	message("digest off")
+	message("digest daily 25:00")
+	expected := []string{
+		"Failures are sent as they happen. Type **digest daily 09:00** or **digest weekly mon** to receive them in a digest.",
+		"Digest already off",
+		"Invalid time `25:00`, expected e.g. 09:00",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	message("digest weekly Mon")
+	sent = nil
+	message("digest")
+	if expected := []string{"Failures are sent in a digest, weekly on Monday at 09:00 UTC."}; !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	sent = nil
+	var out outbox
+	for _, res := range []logResult{
+		{attrPath: "foo", state: logState{Logs: []logEntry{{Date: "2000-01-02", Category: classifier.BuildError, Matches: []string{"error: boom"}, Fingerprint: "a"}}}},
+		{attrPath: "bar", state: logState{Logs: []logEntry{{Date: "2000-01-02", Category: classifier.BuildError, Matches: []string{"error: boom"}, Fingerprint: "a"}}}},
+		{attrPath: "baz", state: logState{Logs: []logEntry{{Date: "2000-01-02", Category: classifier.BuildError}}}},
+		{attrPath: "baz", state: logState{Logs: []logEntry{{Date: "2000-01-03", Category: classifier.Success}}}},
+	} {
+		handleLogResult(ctx, res, &out)
+	}
+	out.flush(ctx)
+
+	// only failures are queued
+	if expected := []string{"Package `baz` builds again: https://nixpkgs-update-logs.nix-community.org/baz/2000-01-03.log"}; !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	sent = nil
+	sendDigests(ctx)
+	if len(sent) != 0 {
+		t.Errorf("digest sent before it was due: %q", sent)
+	}
+
+	if _, err := clients.db.Exec("UPDATE digests SET last_sent = datetime('now', '-8 days')"); err != nil {
+		panic(err)
+	}
+	sendDigests(ctx)
+	expected = []string{"Your weekly digest: 3 failures\n\n" +
+		"2 packages failing with the same build error:\n\n```\nerror: boom\n```\n\n" +
+		"- `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-02.log\n" +
+		"- `bar`: https://nixpkgs-update-logs.nix-community.org/bar/2000-01-02.log\n\n" +
+		"New build error for package `baz`: https://nixpkgs-update-logs.nix-community.org/baz/2000-01-02.log",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	// the queue was emptied
+	sent = nil
+	if _, err := clients.db.Exec("UPDATE digests SET last_sent = datetime('now', '-8 days')"); err != nil {
+		panic(err)
+	}
+	sendDigests(ctx)
+	if len(sent) != 0 {
+		t.Errorf("expected no digest, got: %q", sent)
+	}
+
+	// turning digests off sends what's queued
+	var out2 outbox
+	handleLogResult(ctx, logResult{attrPath: "foo", state: logState{Logs: []logEntry{{Date: "2000-01-04", Category: classifier.BuildError, Fingerprint: "b"}}}}, &out2)
+	out2.flush(ctx)
+	message("digest off")
+	expected = []string{
+		"Failures since your last digest: 1 failure\n\nNew build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-04.log",
+		"Digest off, failures will be sent as they happen.",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+}
+
+func TestDigestSendFailure(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	var sendErr error
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		sender: func(ctx context.Context, text string, _ id.RoomID) (*mautrix.RespSendEvent, error) {
+			if sendErr != nil {
+				return nil, sendErr
+			}
+			// only the digest's title and the failures fit on their own
+			if len(text) > 120 {
+				return nil, mautrix.MTooLarge
+			}
+			sent = append(sent, text)
+			return nil, nil
+		},
+	}
+
+	addPackages("foo", "bar")
+	sub("foo")
+	sub("bar")
+	message("digest daily")
+
+	var out outbox
+	handleLogResult(ctx, logResult{attrPath: "foo", state: logState{Logs: []logEntry{{Date: "2000-01-02", Category: classifier.BuildError}}}}, &out)
+	handleLogResult(ctx, logResult{attrPath: "bar", state: logState{Logs: []logEntry{{Date: "2000-01-02", Category: classifier.BuildError}}}}, &out)
+	out.flush(ctx)
+
+	queued := func() int {
+		var n int
+		if err := clients.db.QueryRow("SELECT COUNT(*) FROM digest_queue").Scan(&n); err != nil {
+			panic(err)
+		}
+		return n
+	}
+
+	if _, err := clients.db.Exec("UPDATE digests SET last_sent = datetime('now', '-2 days')"); err != nil {
+		panic(err)
+	}
+
+	sent = nil
+	sendErr = errors.New("connection refused")
+	sendDigests(ctx)
+	if n := queued(); n != 2 {
+		t.Errorf("expected failures to stay queued, got %d", n)
+	}
+
+	message("digest off")
+	sendErr = nil
+	message("digest")
+	if expected := []string{"Failures are sent in a digest, daily at 09:00 UTC."}; !slices.Equal(expected, sent) {
+		t.Errorf("expected the digest to stay on, got: %q", sent)
+	}
+
+	// retried on the next tick, split because it's too large
+	sent = nil
+	sendDigests(ctx)
+	expected := []string{
+		"Your daily digest: 2 failures",
+		"New build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-02.log",
+		"New build error for package `bar`: https://nixpkgs-update-logs.nix-community.org/bar/2000-01-02.log",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+	if n := queued(); n != 0 {
+		t.Errorf("expected the queue to be emptied, got %d", n)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+var httpCache = flag.Bool("http.cache", true, "Store fetched pages in the DB and revalidate them with conditional requests")
+
+// call is an in-flight makeRequest, shared by all callers requesting the same URL.
+type call struct {
+	wg       sync.WaitGroup
+	body     []byte
+	modified bool
+	err      error
+}
+
+var inflight = struct {
+	sync.Mutex
+	calls map[string]*call
+}{
+	calls: make(map[string]*call),
+}
+
+// makeRequest fetches url, returning its body.
+//
+// Concurrent requests for the same URL are collapsed into one, and responses
+// are cached in the http_cache table, so that unchanged pages cost a 304 instead
+// of a full download.
+//
+// The returned slice is shared between callers and must not be modified.
+func makeRequest(ctx context.Context, url string) ([]byte, error) {
+	body, _, err := makeConditionalRequest(ctx, url)
+
+	return body, err
+}
+
+// makeConditionalRequest is like makeRequest, but also returns whether the
+// body changed since it was cached, i.e. false if the server replied with a 304.
+func makeConditionalRequest(ctx context.Context, url string) ([]byte, bool, error) {
+	inflight.Lock()
+	if c, ok := inflight.calls[url]; ok {
+		inflight.Unlock()
+		c.wg.Wait()
+
+		return c.body, c.modified, c.err
+	}
+	c := &call{}
+	c.wg.Add(1)
+	inflight.calls[url] = c
+	inflight.Unlock()
+
+	c.body, c.modified, c.err = fetchWithCache(ctx, url)
+	c.wg.Done()
+
+	inflight.Lock()
+	delete(inflight.calls, url)
+	inflight.Unlock()
+
+	return c.body, c.modified, c.err
+}
+
+type cacheEntry struct {
+	etag         sql.NullString
+	lastModified sql.NullString
+	body         []byte
+}
+
+func fetchWithCache(ctx context.Context, url string) ([]byte, bool, error) {
+	req, err := newReqWithUA(ctx, url)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var cached *cacheEntry
+	if *httpCache {
+		var e cacheEntry
+		err := clients.db.QueryRowContext(ctx, "SELECT etag, last_modified, body FROM http_cache WHERE url = ?", url).Scan(&e.etag, &e.lastModified, &e.body)
+		if err == nil {
+			cached = &e
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return nil, false, err
+		}
+	}
+
+	if cached != nil {
+		if cached.etag.Valid {
+			req.Header.Set("If-None-Match", cached.etag.String)
+		}
+		if cached.lastModified.Valid {
+			req.Header.Set("If-Modified-Since", cached.lastModified.String)
+		}
+	}
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		slog.Debug("cache hit", "url", url)
+
+		if _, err := clients.db.ExecContext(ctx, "UPDATE http_cache SET fetched_at = CURRENT_TIMESTAMP WHERE url = ?", url); err != nil {
+			return nil, false, err
+		}
+
+		return cached.body, false, nil
+	}
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, &HTTPError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if *httpCache && (etag != "" || lastModified != "") {
+		if _, err := clients.db.ExecContext(ctx, `
+      INSERT INTO http_cache(url, etag, last_modified, body) VALUES (?, NULLIF(?, ''), NULLIF(?, ''), ?)
+      ON CONFLICT(url) DO UPDATE SET
+        etag = excluded.etag,
+        last_modified = excluded.last_modified,
+        body = excluded.body,
+        fetched_at = CURRENT_TIMESTAMP`, url, etag, lastModified, body); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return body, true, nil
+}
+
+// pruneHTTPCache removes cache entries that haven't been used in a while, e.g.
+// because the package they belong to doesn't exist anymore.
+func pruneHTTPCache(ctx context.Context) error {
+	res, err := clients.db.ExecContext(ctx, "DELETE FROM http_cache WHERE fetched_at < datetime('now', '-30 days')")
+	if err != nil {
+		return err
+	}
+
+	n, _ := res.RowsAffected()
+	slog.Info("pruned HTTP cache", "entries", n)
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMakeRequestCache(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var full, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+
+		full.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	for range 3 {
+		body, err := makeRequest(ctx, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello" {
+			t.Errorf("unexpected body: %s", body)
+		}
+	}
+
+	if full.Load() != 1 {
+		t.Errorf("expected 1 full response, got %d", full.Load())
+	}
+	if notModified.Load() != 2 {
+		t.Errorf("expected 2 revalidations, got %d", notModified.Load())
+	}
+}
+
+func TestMakeRequestCollapsesConcurrentFetches(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var hits atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := makeRequest(ctx, srv.URL); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// give all goroutines a chance to join the in-flight request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if hits.Load() != 1 {
+		t.Errorf("expected 1 request, got %d", hits.Load())
+	}
+}
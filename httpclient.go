@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var httpTimeout = flag.Duration("http.timeout", time.Minute, "Timeout for a single HTTP request, including reading the body")
+var jsblobTimeout = flag.Duration("http.jsblob-timeout", 10*time.Minute, "Timeout for downloading and parsing packages.json.br")
+var httpRetries = flag.Int("http.retries", 3, "How many times to retry failed HTTP requests")
+var httpMaxBody = flag.Int64("http.max-body", 64<<20, "Maximum size in bytes of an HTTP response body")
+
+const (
+	// how many consecutive failures open a host's circuit
+	breakerThreshold = 5
+	// how long an open circuit rejects requests for
+	breakerCooldown = 5 * time.Minute
+	// upper bound for backoff and Retry-After delays
+	maxRetryDelay = 2 * time.Minute
+)
+
+// base delay for exponential backoff, variable so that tests can shorten it
+var retryBaseDelay = 500 * time.Millisecond
+
+// TransportError is returned when no response could be received, e.g. because of a timeout.
+type TransportError struct {
+	URL string
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("requesting %s: %s", e.URL, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// CircuitOpenError is returned without making a request, when a host has failed too many times in a row.
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("too many failures for %s, not retrying until %s", e.Host, e.Until.Format(time.TimeOnly))
+}
+
+// BodyTooLargeError is returned when a response body exceeds -http.max-body.
+type BodyTooLargeError struct {
+	URL   string
+	Limit int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	return fmt.Sprintf("response body for %s exceeds %d bytes", e.URL, e.Limit)
+}
+
+// Whether err was caused by the network or a remote server, as opposed to e.g. the DB.
+func isNetworkError(err error) bool {
+	var httpErr *HTTPError
+	var transportErr *TransportError
+	var circuitErr *CircuitOpenError
+	var sizeErr *BodyTooLargeError
+
+	return errors.As(err, &httpErr) || errors.As(err, &transportErr) || errors.As(err, &circuitErr) || errors.As(err, &sizeErr)
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+var breakers = struct {
+	sync.Mutex
+	hosts map[string]*breaker
+}{
+	hosts: make(map[string]*breaker),
+}
+
+func breakerAllow(host string) error {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	if b, ok := breakers.hosts[host]; ok && time.Now().Before(b.openUntil) {
+		return &CircuitOpenError{Host: host, Until: b.openUntil}
+	}
+
+	return nil
+}
+
+// Records the outcome of a request to host, opening its circuit after breakerThreshold consecutive failures.
+func breakerRecord(host string, failed bool) {
+	breakers.Lock()
+	defer breakers.Unlock()
+
+	b, ok := breakers.hosts[host]
+	if !ok {
+		b = &breaker{}
+		breakers.hosts[host] = b
+	}
+
+	if !failed {
+		b.failures = 0
+
+		return
+	}
+
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = time.Now().Add(breakerCooldown)
+		slog.Warn("opening circuit", "host", host, "failures", b.failures, "until", b.openUntil)
+	}
+}
+
+// doRequest sends req, retrying with jittered exponential backoff on transport
+// errors, 5xx and 429 responses.
+//
+// Any other response is returned as-is, and it's up to the caller to check its
+// status code and close its body.
+func doRequest(req *http.Request) (*http.Response, error) {
+	return doRequestWith(clients.http, req)
+}
+
+// doRequestWith is like doRequest, but sends req with client, e.g. to use a
+// different timeout.
+func doRequestWith(client *http.Client, req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := breakerAllow(host); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		var err error
+		var wait time.Duration
+
+		resp, doErr := client.Do(req)
+		if doErr != nil {
+			err = &TransportError{URL: req.URL.String(), Err: doErr}
+		} else if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+			resp.Body.Close()
+
+			err = &HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
+			wait = retryAfter(resp)
+		} else {
+			breakerRecord(host, false)
+
+			return resp, nil
+		}
+
+		if attempt >= *httpRetries || req.Context().Err() != nil {
+			breakerRecord(host, true)
+
+			return nil, err
+		}
+
+		wait = max(wait, backoff(attempt))
+		slog.Debug("retrying request", "url", req.URL, "attempt", attempt+1, "wait", wait, "err", err)
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, &TransportError{URL: req.URL.String(), Err: req.Context().Err()}
+		}
+	}
+}
+
+// Returns a random delay between 0 and retryBaseDelay * 2^attempt.
+func backoff(attempt int) time.Duration {
+	d := min(retryBaseDelay<<attempt, maxRetryDelay)
+
+	return rand.N(d + 1)
+}
+
+// Parses the Retry-After header, which can either be in seconds or an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	}
+
+	return min(max(d, 0), maxRetryDelay)
+}
+
+// Reads a response body, failing if it's larger than -http.max-body.
+func readBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, *httpMaxBody+1))
+	if err != nil {
+		return nil, &TransportError{URL: resp.Request.URL.String(), Err: err}
+	}
+
+	if int64(len(body)) > *httpMaxBody {
+		return nil, &BodyTooLargeError{URL: resp.Request.URL.String(), Limit: *httpMaxBody}
+	}
+
+	return body, nil
+}
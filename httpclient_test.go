@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	retryBaseDelay = time.Millisecond
+}
+
+func TestDoRequestRetries(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	req, err := newReqWithUA(ctx, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := doRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if hits.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", hits.Load())
+	}
+}
+
+func TestDoRequestCircuitBreaker(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	var httpErr *HTTPError
+	for range breakerThreshold {
+		req, _ := newReqWithUA(ctx, srv.URL)
+		if _, err := doRequest(req); !errors.As(err, &httpErr) {
+			t.Fatalf("expected HTTPError, got %v", err)
+		}
+	}
+
+	if expected := int32(breakerThreshold * (*httpRetries + 1)); hits.Load() != expected {
+		t.Errorf("expected %d attempts, got %d", expected, hits.Load())
+	}
+
+	req, _ := newReqWithUA(ctx, srv.URL)
+	var circuitErr *CircuitOpenError
+	if _, err := doRequest(req); !errors.As(err, &circuitErr) {
+		t.Errorf("expected CircuitOpenError, got %v", err)
+	}
+	if !isNetworkError(circuitErr) {
+		t.Error("CircuitOpenError should be a network error")
+	}
+}
+
+func TestReadBodyLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer srv.Close()
+
+	limit := *httpMaxBody
+	*httpMaxBody = 5
+	defer func() { *httpMaxBody = limit }()
+
+	req, _ := newReqWithUA(ctx, srv.URL)
+	resp, err := doRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var sizeErr *BodyTooLargeError
+	if _, err := readBody(resp); !errors.As(err, &sizeErr) {
+		t.Errorf("expected BodyTooLargeError, got %v", err)
+	}
+}
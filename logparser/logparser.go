@@ -0,0 +1,93 @@
+// Package logparser extracts structured data from nixpkgs-update logs.
+package logparser
+
+import (
+	"regexp"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+)
+
+// Outcome is what nixpkgs-update ended up doing.
+type Outcome string
+
+const (
+	// A pull request was opened.
+	PROpened Outcome = "pr-opened"
+	// The update failed.
+	Failed Outcome = "failed"
+	// nixpkgs-update decided not to update the package.
+	Skipped Outcome = "skipped"
+	// The update didn't fail, but no pull request was opened, e.g. because one already exists.
+	NoPR Outcome = "no-pr"
+)
+
+var (
+	// e.g. "python3Packages.foo 1.0 -> 1.1 https://pypi.org/project/foo"
+	header = regexp.MustCompile(`^(\S+) (\S+) -> (\S+)(?: (https?://\S+))?$`)
+	// nixpkgs-update prints the URL of the PR it opened on a line of its own.
+	// Other PR links, e.g. to already open PRs, appear within sentences.
+	prURL = regexp.MustCompile(`^https://github\.com/NixOS/nixpkgs/pull/\d+$`)
+)
+
+// The header is expected within the first lines of a log.
+const headerLines = 10
+
+// Result is the data extracted from a log.
+type Result struct {
+	OldVersion string
+	NewVersion string
+	// URL of the upstream release nixpkgs-update tried to update to.
+	UpdateURL string
+	// URL of the pull request opened by nixpkgs-update, if any.
+	PRURL   string
+	Outcome Outcome
+}
+
+// Parser consumes a log line by line.
+type Parser struct {
+	lines int
+	res   Result
+}
+
+// Line feeds the next line of the log to the parser.
+func (p *Parser) Line(line string) {
+	p.lines++
+
+	if p.res.NewVersion == "" && p.lines <= headerLines {
+		if m := header.FindStringSubmatch(line); m != nil {
+			p.res.OldVersion, p.res.NewVersion, p.res.UpdateURL = m[2], m[3], m[4]
+		}
+	}
+
+	if prURL.MatchString(line) {
+		p.res.PRURL = line
+	}
+}
+
+// Result returns the data extracted so far, given the log's category.
+func (p *Parser) Result(category classifier.Category) Result {
+	res := p.res
+
+	switch {
+	case res.PRURL != "":
+		res.Outcome = PROpened
+	case category.Failed():
+		res.Outcome = Failed
+	case category == classifier.NoUpdate:
+		res.Outcome = Skipped
+	default:
+		res.Outcome = NoPR
+	}
+
+	return res
+}
+
+// Parse extracts data from a whole log.
+func Parse(lines []string, category classifier.Category) Result {
+	var p Parser
+	for _, l := range lines {
+		p.Line(l)
+	}
+
+	return p.Result(category)
+}
@@ -0,0 +1,67 @@
+package logparser
+
+import (
+	"testing"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+)
+
+func TestParse(t *testing.T) {
+	tt := []struct {
+		name     string
+		lines    []string
+		category classifier.Category
+		expected Result
+	}{
+		{
+			name: "pr opened",
+			lines: []string{
+				"python3Packages.foo 1.0 -> 1.1 https://pypi.org/project/foo",
+				"attrpath: python3Packages.foo",
+				"There might already be an open PR for this update: https://github.com/NixOS/nixpkgs/pull/1",
+				"https://github.com/NixOS/nixpkgs/pull/123456",
+			},
+			category: classifier.Success,
+			expected: Result{
+				OldVersion: "1.0",
+				NewVersion: "1.1",
+				UpdateURL:  "https://pypi.org/project/foo",
+				PRURL:      "https://github.com/NixOS/nixpkgs/pull/123456",
+				Outcome:    PROpened,
+			},
+		},
+		{
+			name: "failed",
+			lines: []string{
+				"foo 1.0 -> 1.1",
+				"error: hash mismatch in fixed-output derivation",
+			},
+			category: classifier.HashMismatch,
+			expected: Result{
+				OldVersion: "1.0",
+				NewVersion: "1.1",
+				Outcome:    Failed,
+			},
+		},
+		{
+			name:     "skipped",
+			lines:    []string{"Skipping because reasons"},
+			category: classifier.NoUpdate,
+			expected: Result{Outcome: Skipped},
+		},
+		{
+			name:     "no pr",
+			lines:    []string{"foo 1.0 -> 1.1", "An auto update branch exists"},
+			category: classifier.Success,
+			expected: Result{OldVersion: "1.0", NewVersion: "1.1", Outcome: NoPR},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Parse(tc.lines, tc.category); got != tc.expected {
+				t.Errorf("expected: %+v\ngot: %+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+	"github.com/asymmetric/nixpkgs-update-notifier/logparser"
+)
+
+var logMaxBytes = flag.Int64("log.max-bytes", 16<<20, "Maximum number of bytes of a log that are scanned")
+
+const (
+	// Lines of context shown around each matched line in excerpts.
+	excerptContext = 2
+	// Maximum number of lines in an excerpt.
+	maxExcerptLines = 15
+	// Longer lines are truncated in excerpts.
+	maxExcerptLineLength = 200
+	// Longer lines are truncated before being scanned.
+	maxLineLength = 64 << 10
+)
+
+// Classifies and parses a log line by line as it's read, returning its
+// category and the lines that decided it, together with an excerpt showing
+// them with some surrounding context.
+//
+// At most -log.max-bytes are read, and reading stops early once the category
+// is certain. Only the lines needed for the excerpt are kept in memory.
+func scanLog(r io.Reader) (logEntry, error) {
+	lr := &io.LimitedReader{R: r, N: *logMaxBytes}
+	br := bufio.NewReader(lr)
+
+	cs := logClassifier.NewScanner()
+	var p logparser.Parser
+	var ex excerpt
+
+	for n := 0; ; n++ {
+		line, err := readLine(br)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return logEntry{}, err
+		}
+
+		matched := cs.Line(line)
+		p.Line(line)
+		ex.line(n, line, matched)
+
+		// once the verdict can't change, further matches would only add to
+		// the excerpt, after the lines that decided it
+		if cs.Certain() && ex.settled() {
+			slog.Debug("stopped scanning log early", "lines", n+1)
+
+			break
+		}
+	}
+	if lr.N <= 0 {
+		slog.Warn("log exceeds maximum size, only scanned its beginning", "max", *logMaxBytes)
+	}
+
+	res := cs.Result()
+	l := logEntry{
+		Category: res.Category,
+		Rule:     res.Rule,
+		Excerpt:  ex.String(),
+		Result:   p.Result(res.Category),
+	}
+	for _, m := range res.Matches {
+		l.Matches = append(l.Matches, m.Text)
+	}
+	l.Fingerprint = classifier.Fingerprint(l.Matches)
+
+	return l, nil
+}
+
+// Reads a line without its line ending, truncating it to maxLineLength.
+func readLine(br *bufio.Reader) (string, error) {
+	var sb strings.Builder
+
+	for {
+		chunk, isPrefix, err := br.ReadLine()
+		if err != nil {
+			// a final line without newline has already been returned by a previous call
+			return "", err
+		}
+
+		if sb.Len() < maxLineLength {
+			sb.Write(chunk[:min(len(chunk), maxLineLength-sb.Len())])
+		}
+
+		if !isPrefix {
+			return sb.String(), nil
+		}
+	}
+}
+
+// excerpt collects matched lines with excerptContext lines around each of
+// them, keeping only the lines it needs. Non-contiguous blocks are separated
+// by "...".
+type excerpt struct {
+	out []string
+	// the last unmatched lines, which might precede a match
+	before []numberedLine
+	// how many of the following lines are context of a match
+	after int
+	// number of the last line added to out
+	last int
+	// whether out has reached maxExcerptLines
+	truncated bool
+}
+
+type numberedLine struct {
+	n    int
+	text string
+}
+
+func (e *excerpt) line(n int, text string, matched bool) {
+	if e.truncated {
+		return
+	}
+
+	switch {
+	case matched:
+		for _, l := range e.before {
+			e.add(l.n, l.text)
+		}
+		e.before = e.before[:0]
+		e.add(n, text)
+		e.after = excerptContext
+	case e.after > 0:
+		e.add(n, text)
+		e.after--
+	case excerptContext > 0:
+		if len(e.before) == excerptContext {
+			e.before = append(e.before[:0], e.before[1:]...)
+		}
+		e.before = append(e.before, numberedLine{n, text})
+	}
+}
+
+func (e *excerpt) add(n int, text string) {
+	if e.truncated {
+		return
+	}
+	if len(e.out) == maxExcerptLines {
+		e.out = append(e.out, "...")
+		e.truncated = true
+
+		return
+	}
+
+	if len(e.out) > 0 && n > e.last+1 {
+		e.out = append(e.out, "...")
+	}
+	e.out = append(e.out, truncate(text, maxExcerptLineLength))
+	e.last = n
+}
+
+// Whether the excerpt has the context following all the matches so far.
+func (e *excerpt) settled() bool {
+	return e.truncated || e.after == 0
+}
+
+func (e *excerpt) String() string {
+	return strings.Join(e.out, "\n")
+}
+
+// Truncates s to n bytes, marking it with an ellipsis.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	return strings.ToValidUTF8(s[:n], "") + "…"
+}
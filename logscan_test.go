@@ -0,0 +1,123 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+)
+
+func TestScanLog(t *testing.T) {
+	body := "python3Packages.foo 1.0 -> 1.1\nerror: builder for '/nix/store/foo.drv' failed\nsome output\r\nReceived ExitFailure 1 when running\n"
+
+	expected := []string{
+		"error: builder for '/nix/store/foo.drv' failed",
+		"Received ExitFailure 1 when running",
+	}
+	l, err := scanLog(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expected, l.Matches) {
+		t.Errorf("expected: %v\ngot: %v", expected, l.Matches)
+	}
+	if l.Category != classifier.BuildError || l.Rule != "nix-error" {
+		t.Errorf("expected: %s; got: %s (%s)", classifier.BuildError, l.Category, l.Rule)
+	}
+
+	expectedExcerpt := strings.Join([]string{
+		"python3Packages.foo 1.0 -> 1.1",
+		"error: builder for '/nix/store/foo.drv' failed",
+		"some output",
+		"Received ExitFailure 1 when running",
+	}, "\n")
+	if l.Excerpt != expectedExcerpt {
+		t.Errorf("expected: %q\ngot: %q", expectedExcerpt, l.Excerpt)
+	}
+}
+
+func TestScanLogStopsEarly(t *testing.T) {
+	lines := []string{
+		"error: hash mismatch in fixed-output derivation '/nix/store/foo.drv':",
+		"specified: sha256-AAAA",
+		"got: sha256-BBBB",
+		"error: builder for '/nix/store/bar.drv' failed",
+	}
+
+	l, err := scanLog(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Category != classifier.HashMismatch {
+		t.Errorf("expected: %s; got: %s", classifier.HashMismatch, l.Category)
+	}
+	if len(l.Matches) != 1 {
+		t.Errorf("scanned past the verdict: %q", l.Matches)
+	}
+	if expected := strings.Join(lines[:3], "\n"); l.Excerpt != expected {
+		t.Errorf("expected: %q\ngot: %q", expected, l.Excerpt)
+	}
+}
+
+func TestScanLogMaxBytes(t *testing.T) {
+	defer func(n int64) { *logMaxBytes = n }(*logMaxBytes)
+	*logMaxBytes = 100
+
+	body := strings.Repeat("all good\n", 100) + "error: builder for '/nix/store/foo.drv' failed\n"
+
+	l, err := scanLog(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Category != classifier.Success {
+		t.Errorf("scanned past the limit: %s", l.Category)
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	var lines []string
+	for i := range 100 {
+		lines = append(lines, strings.Repeat("x", i))
+	}
+	lines[50] = strings.Repeat("y", 300)
+
+	makeExcerpt := func(matches ...int) []string {
+		var e excerpt
+		for i, l := range lines {
+			e.line(i, l, slices.Contains(matches, i))
+		}
+
+		return strings.Split(e.String(), "\n")
+	}
+
+	t.Run("separate blocks", func(t *testing.T) {
+		got := makeExcerpt(0, 10)
+		expected := []string{lines[0], lines[1], lines[2], "...", lines[8], lines[9], lines[10], lines[11], lines[12]}
+		if !slices.Equal(expected, got) {
+			t.Errorf("expected: %q\ngot: %q", expected, got)
+		}
+	})
+
+	t.Run("overlapping blocks", func(t *testing.T) {
+		got := makeExcerpt(10, 13)
+		expected := lines[8:16]
+		if !slices.Equal(expected, got) {
+			t.Errorf("expected: %q\ngot: %q", expected, got)
+		}
+	})
+
+	t.Run("long lines", func(t *testing.T) {
+		got := makeExcerpt(50)
+		if l := got[2]; l != strings.Repeat("y", maxExcerptLineLength)+"…" {
+			t.Errorf("line not truncated: %s", l)
+		}
+	})
+
+	t.Run("too many lines", func(t *testing.T) {
+		got := makeExcerpt(10, 20, 30, 40)
+		if len(got) != maxExcerptLines+1 || got[len(got)-1] != "..." {
+			t.Errorf("excerpt not truncated: %q", got)
+		}
+	})
+}
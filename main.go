@@ -5,15 +5,20 @@ import (
 	"context"
 	"database/sql"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/antchfx/htmlquery"
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+	"github.com/asymmetric/nixpkgs-update-notifier/logparser"
 	"github.com/asymmetric/nixpkgs-update-notifier/regexes"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/net/html"
@@ -27,16 +32,22 @@ var matrixUsername = flag.String("matrix.username", "", "Matrix bot username")
 
 var mainURL = flag.String("url", "https://nixpkgs-update-logs.nix-community.org", "Webpage with logs")
 var dbPath = flag.String("db", "data.db", "Path to the DB file")
-var updateTickerOpt = flag.Duration("timers.update", 24*time.Hour, "How often to check for new errors")
+var updateTickerOpt = flag.Duration("timers.update", time.Hour, "How often to scrape the main page and check packages that are due")
 var jsonTickerOpt = flag.Duration("timers.jsblob", 5*time.Minute, "How often to fetch packages.json.br")
+var classifierRules = flag.String("classifier.rules", "", "JSON file with the rules used to classify logs (default: built-in rules)")
+var updateWorkers = flag.Int("update.workers", 4, "Number of packages to check concurrently during an update")
 var debug = flag.Bool("debug", false, "Enable debug logging")
+var admins = flag.String("admins", "", "Comma-separated Matrix IDs allowed to use admin commands")
 
 var clients = struct {
-	db     *sql.DB
-	http   *http.Client
-	matrix *mautrix.Client
+	db   *sql.DB
+	http *http.Client
+	// for packages.json.br, which takes longer to download and parse than pages
+	jsblobHTTP *http.Client
+	matrix     *mautrix.Client
 }{
-	http: &http.Client{},
+	http:       &http.Client{},
+	jsblobHTTP: &http.Client{},
 }
 
 // TODO: rename last_visited to last_log_date?
@@ -58,8 +69,8 @@ const packagesURL = "https://channels.nixos.org/nixos-unstable/packages.json.br"
 
 // These are abstracted so that we can pass a different function in tests.
 type handlers struct {
-	// Fetches logs for a URL.
-	logFetcher func(context.Context, string) (string, bool, error)
+	// Fetches logs for a URL, newer than a date.
+	logFetcher func(context.Context, string, string) (logState, error)
 	// Fetches last log date for a URL.
 	dateFetcher func(context.Context, string) (string, error)
 	// Sends messages to  a user via Matrix.
@@ -68,6 +79,9 @@ type handlers struct {
 
 var h handlers
 
+// logClassifier decides whether a log is a failure. It's replaced at startup if -classifier.rules is set.
+var logClassifier = classifier.Default()
+
 // jsblob stores the unmarshaled packages.json.
 var jsblob map[string]any
 var mu sync.RWMutex
@@ -75,7 +89,7 @@ var mu sync.RWMutex
 func init() {
 	// default handlers
 	h = handlers{
-		logFetcher:  fetchLatestLogState,
+		logFetcher:  fetchNewLogs,
 		dateFetcher: fetchLatestLogDate,
 		sender:      sendMarkdown,
 	}
@@ -86,6 +100,26 @@ func main() {
 
 	setupLogger()
 
+	clients.http.Timeout = *httpTimeout
+	clients.jsblobHTTP.Timeout = *jsblobTimeout
+
+	if *classifierRules != "" {
+		c, err := classifier.Load(*classifierRules)
+		if err != nil {
+			panic(err)
+		}
+		logClassifier = c
+	}
+
+	if flag.Arg(0) == "classify" {
+		if err := runClassify(flag.Args()[1:], os.Stdout); err != nil {
+			slog.Error("classify", "err", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	ctx := context.Background()
 	if err := setupDB(ctx, fmt.Sprintf("file:%s", *dbPath)); err != nil {
 		panic(err)
@@ -102,6 +136,7 @@ func main() {
 	updateTicker := time.NewTicker(*updateTickerOpt)
 	optimizeTicker := time.NewTicker(24 * time.Hour)
 	jsonTicker := time.NewTicker(*jsonTickerOpt)
+	digestTicker := time.NewTicker(time.Minute)
 	slog.Debug("delay set", "value", *updateTickerOpt)
 
 	// - fetch main page, add list of packages to mem
@@ -119,209 +154,456 @@ func main() {
 	slog.Info("initialized", "delay", updateTickerOpt)
 
 	storeAttrPaths(ctx, *mainURL)
+	reconcileRules(ctx, ruleGlob)
 	updateSubs(ctx)
-	fetchPackagesJSON(ctx)
+	if changed, err := fetchPackagesJSON(ctx); err != nil {
+		slog.Error("fetching packages.json", "err", err)
+	} else if changed {
+		reconcileRules(ctx, ruleMaintainer, ruleTeam)
+	}
 
 	for {
 		select {
 		case <-updateTicker.C:
 			slog.Info("new ticker run")
-			storeAttrPaths(ctx, *mainURL)
+			// new packages only show up when the main page changed
+			if storeAttrPaths(ctx, *mainURL) {
+				reconcileRules(ctx, ruleGlob)
+			}
 			updateSubs(ctx)
 		case <-jsonTicker.C:
 			// NOTE: in theory, this could be done in a goroutine, but in practice,
 			// the program is idling so often that it's not really necessary.
-			fetchPackagesJSON(ctx)
+			if changed, err := fetchPackagesJSON(ctx); err != nil {
+				slog.Error("fetching packages.json", "err", err)
+			} else if changed {
+				reconcileRules(ctx, ruleMaintainer, ruleTeam)
+			}
+		case <-digestTicker.C:
+			sendDigests(ctx)
 		case <-optimizeTicker.C:
 			slog.Info("optimizing DB")
 			if _, err := clients.db.ExecContext(ctx, "PRAGMA optimize;"); err != nil {
 				panic(err)
 			}
+			if err := pruneHTTPCache(ctx); err != nil {
+				fatal(err)
+			}
 		}
 	}
 }
 
-// scrapes the main page, saving package names to db
-func storeAttrPaths(ctx context.Context, url string) {
-	body, err := makeRequest(ctx, url)
+// scrapes the main page, saving package names and the modification time of
+// their directory to db
+//
+// It returns whether the packages were updated, which they aren't if the main
+// page hasn't changed since the last scrape.
+func storeAttrPaths(ctx context.Context, url string) bool {
+	body, modified, err := makeConditionalRequest(ctx, url)
 	if err != nil {
-		panic(err)
+		if isNetworkError(err) {
+			slog.Error("fetching main page, keeping known packages", "err", err)
+
+			return false
+		}
+		fatal(err)
+	}
+	if !modified {
+		slog.Info("main page not modified, keeping known packages")
+
+		return false
 	}
 
 	doc, err := html.Parse(bytes.NewReader(body))
 	if err != nil {
-		panic(err)
+		slog.Error("parsing main page, keeping known packages", "err", err)
+
+		return false
 	}
 
-	hrefs := htmlquery.Find(doc, "//a/@href")
-	slog.Info("storing attr paths", "count", len(hrefs))
-	for _, href := range hrefs {
-		attr_path := strings.TrimSuffix(htmlquery.InnerText(href), "/")
+	tx, err := clients.db.BeginTx(ctx, nil)
+	if err != nil {
+		fatal(err)
+	}
+	defer tx.Rollback()
+
+	links := htmlquery.Find(doc, "//a[@href]")
+	slog.Info("storing attr paths", "count", len(links))
+	for _, a := range links {
+		attr_path := strings.TrimSuffix(htmlquery.SelectAttr(a, "href"), "/")
 		if regexes.Ignore().MatchString(attr_path) {
 			continue
 		}
-		if _, err := clients.db.ExecContext(ctx, "INSERT OR IGNORE INTO packages(attr_path) VALUES (?)", attr_path); err != nil {
+
+		// NULL means we don't know, so the package will always be checked.
+		var lastModified *string
+		if a.NextSibling != nil && a.NextSibling.Type == html.TextNode {
+			if t, err := time.Parse("02-Jan-2006 15:04", regexes.IndexDate().FindString(a.NextSibling.Data)); err == nil {
+				lm := t.Format(time.DateOnly + " 15:04")
+				lastModified = &lm
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+      INSERT INTO packages(attr_path, last_modified) VALUES (?, ?)
+      ON CONFLICT(attr_path) DO UPDATE SET last_modified = excluded.last_modified
+      WHERE last_modified IS NOT excluded.last_modified`, attr_path, lastModified); err != nil {
 			fatal(err)
 		}
 	}
+
+	if err := tx.Commit(); err != nil {
+		fatal(err)
+	}
+
+	return true
+}
+
+// logEntry is a single, fetched log of a package.
+type logEntry struct {
+	Date     string
+	Category classifier.Category
+	// Name of the classifier rule that decided Category.
+	Rule string
+	// Lines of the log matched by failure rules.
+	Matches []string
+	// Matched lines with some surrounding context, for notifications.
+	Excerpt string
+	// Identifies the failure, see classifier.Fingerprint.
+	Fingerprint string
+
+	// Versions, PR link and outcome parsed from the log.
+	logparser.Result
+}
+
+// logState describes the logs of a package.
+type logState struct {
+	// Fetched logs, oldest first.
+	Logs []logEntry
+	// Dates of all the package's logs, oldest first.
+	History []string
+}
+
+// Maximum number of new logs fetched per package and update, e.g. after the
+// bot has been down for a while. Only the most recent ones are fetched.
+const maxNewLogs = 10
+
+// Values of the logs.status column.
+const (
+	logStatusOK    = "ok"
+	logStatusError = "error"
+)
+
+// logResult is the outcome of a single logFetcher call, as produced by the updateSubs workers.
+type logResult struct {
+	attrPath string
+	state    logState
+	err      error
 }
 
-// Iterates over subscribed-to packages, and fetches their latest log, printing out whether it contained an error.
-// It also updates the packages.last_visited column.
+// Iterates over subscribed-to packages, and fetches the logs added since their last visited one, printing out whether they contained an error.
+// It also updates the packages.last_visited, packages.checked_modified and packages.next_check columns.
+//
+// A package is checked when its directory on the main page was modified since
+// its last successful check, since it might have a new log, or when its
+// next_check time has passed (see nextCheckInterval). The schedule covers what
+// modification times miss: packages the main page doesn't list a time for, and
+// logs that were rewritten in place, which leaves the directory's time as is.
+//
+// Logs are fetched concurrently by a pool of -update.workers goroutines, but
+// results are handled sequentially and in attr_path order, so that DB writes
+// and notifications don't race with each other.
 func updateSubs(ctx context.Context) {
-	rows, err := clients.db.QueryContext(ctx, "SELECT attr_path FROM subscriptions ORDER BY attr_path")
+	if _, err := clients.db.ExecContext(ctx, "UPDATE subscriptions SET muted_until = NULL WHERE muted_until <= datetime('now')"); err != nil {
+		fatal(err)
+	}
+
+	rows, err := clients.db.QueryContext(ctx, `
+    SELECT DISTINCT s.attr_path, p.last_visited
+    FROM subscriptions s JOIN packages p USING (attr_path)
+    WHERE p.last_modified IS NOT p.checked_modified
+      OR p.next_check IS NULL OR p.next_check <= datetime('now')
+    ORDER BY s.attr_path`)
 	if err != nil {
 		fatal(err)
 	}
 	defer rows.Close()
 
-	aps := make([]string, 0)
+	pkgs := make([]pkgCheck, 0)
 	for rows.Next() {
-		var ap string
-		if err := rows.Scan(&ap); err != nil {
+		var p pkgCheck
+		if err := rows.Scan(&p.attrPath, &p.lastVisited); err != nil {
 			fatal(err)
 		}
-		aps = append(aps, ap)
+		pkgs = append(pkgs, p)
 	}
 	if err := rows.Err(); err != nil {
 		fatal(err)
 	}
 
-	for _, ap := range aps {
-		url := packageURL(ap)
-		// TODO: make async
-		// TODO: we could sometimes avoid fetching altogether if we passed last_visited
-		logDate, hasLogError, err := h.logFetcher(ctx, url)
-		if err != nil {
-			if httpErr, ok := err.(*HTTPError); ok {
-				if httpErr.StatusCode == http.StatusNotFound {
-					slog.Info("non-existent package detected, deleting it and related subscriptions", "attr_path", ap)
-
-					if _, err := clients.db.ExecContext(ctx, "DELETE FROM packages WHERE attr_path = ?", ap); err != nil {
-						fatal(err)
-					}
-				} else {
-					slog.Error("http error while updating, skipping", "ap", ap, "status", httpErr.StatusCode)
-				}
+	slog.Info("checking packages", "count", len(pkgs))
 
-				continue
-			} else {
-				panic(err)
+	var out outbox
+	for _, res := range fetchLogResults(ctx, pkgs) {
+		handleLogResult(ctx, res, &out)
+	}
+	out.flush(ctx)
+}
+
+// A package to be checked by fetchLogResults.
+type pkgCheck struct {
+	attrPath    string
+	lastVisited string
+}
+
+// fetchLogResults calls h.logFetcher for every package, using at most
+// -update.workers concurrent goroutines.
+//
+// The returned slice is in the same order as pkgs.
+func fetchLogResults(ctx context.Context, pkgs []pkgCheck) []logResult {
+	results := make([]logResult, len(pkgs))
+
+	workers := max(*updateWorkers, 1)
+	idxs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(workers, len(pkgs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range idxs {
+				p := pkgs[i]
+				state, err := h.logFetcher(ctx, packageURL(p.attrPath), p.lastVisited)
+				results[i] = logResult{attrPath: p.attrPath, state: state, err: err}
 			}
-		}
+		}()
+	}
 
-		// avoid duplicate notifications by ensuring we haven't already notified for this log
-		var lv string
-		if err := clients.db.QueryRowContext(ctx, "SELECT last_visited FROM packages WHERE attr_path = ?", ap).Scan(&lv); err != nil {
-			fatal(err)
-		}
-		if logDate > lv {
-			if hasLogError {
-				slog.Info("new log", "err", true, "url", logURL(ap, logDate))
-				notifySubscribers(ctx, ap, logDate)
+	for i := range pkgs {
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+
+	return results
+}
+
+// handleLogResult records the fetched logs newer than packages.last_visited,
+// notifying subscribers about them. Failure notices are queued in out.
+//
+// It must not be called concurrently.
+func handleLogResult(ctx context.Context, res logResult, out *outbox) {
+	ap := res.attrPath
+	if err := res.err; err != nil {
+		if httpErr, ok := err.(*HTTPError); ok {
+			if httpErr.StatusCode == http.StatusNotFound {
+				slog.Info("non-existent package detected, deleting it and related subscriptions", "attr_path", ap)
+
+				if _, err := clients.db.ExecContext(ctx, "DELETE FROM packages WHERE attr_path = ?", ap); err != nil {
+					fatal(err)
+				}
 			} else {
-				slog.Info("new log", "err", false, "url", logURL(ap, logDate))
+				slog.Error("http error while updating, skipping", "ap", ap, "status", httpErr.StatusCode)
 			}
 
-			if _, err := clients.db.ExecContext(ctx, "UPDATE packages SET last_visited = ? WHERE attr_path = ?", logDate, ap); err != nil {
-				fatal(err)
-			}
+			return
+		} else if isNetworkError(err) {
+			slog.Error("network error while updating, skipping", "ap", ap, "err", err)
+
+			return
 		} else {
-			slog.Info("no new log", "url", url, "date", logDate)
+			panic(err)
+		}
+	}
+
+	// avoid duplicate notifications by ensuring we haven't already notified for this log.
+	// last_visited is read again because it might have changed since the log was fetched, e.g. by a new subscription.
+	var lv string
+	if err := clients.db.QueryRowContext(ctx, "SELECT last_visited FROM packages WHERE attr_path = ?", ap).Scan(&lv); err != nil {
+		fatal(err)
+	}
+
+	var found bool
+	for _, l := range res.state.Logs {
+		if l.Date > lv {
+			handleNewLog(ctx, ap, l, out)
+			found = true
 		}
 	}
+	if !found {
+		slog.Info("no new log", "url", packageURL(ap), "last_visited", lv)
+	}
+
+	next := time.Now().UTC().Add(nextCheckInterval(res.state.History, time.Now()))
+	if _, err := clients.db.ExecContext(ctx, "UPDATE packages SET next_check = ?, checked_modified = last_modified WHERE attr_path = ?", next.Format(time.DateTime), ap); err != nil {
+		fatal(err)
+	}
 }
 
-// Given a package URL, it returns the latest log's date, and whether it contained an error.
+// handleNewLog stores a log in the logs table and notifies subscribers about it.
+//
+// Logs of a package must be passed oldest first.
+func handleNewLog(ctx context.Context, ap string, l logEntry, out *outbox) {
+	status := logStatusOK
+	if l.Category.Failed() {
+		status = logStatusError
+	}
+	slog.Info("new log", "category", l.Category, "url", logURL(ap, l.Date))
+
+	var prevStatus string
+	var prevFingerprint sql.NullString
+	if err := clients.db.QueryRowContext(ctx, "SELECT status, fingerprint FROM logs WHERE attr_path = ? ORDER BY date DESC LIMIT 1", ap).Scan(&prevStatus, &prevFingerprint); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		fatal(err)
+	}
+
+	var kind noticeKind
+	if l.Category.Failed() {
+		kind = noticeFailure
+		// the package keeps failing in the same way
+		if prevStatus == logStatusError && l.Fingerprint != "" && l.Fingerprint == prevFingerprint.String {
+			kind = failureReminder(ctx, ap, l.Date)
+		}
+	} else {
+		if prevStatus == logStatusError {
+			kind = noticeFixed
+		}
+
+		// rooms that muted the package until it's fixed are notified again
+		if _, err := clients.db.ExecContext(ctx, "UPDATE subscriptions SET muted_until_fixed = 0 WHERE attr_path = ? AND muted_until_fixed", ap); err != nil {
+			fatal(err)
+		}
+	}
+
+	// this also sets last_visited, via a trigger
+	if _, err := clients.db.ExecContext(ctx, `
+    INSERT INTO logs(attr_path, date, url, status, category, rule, matched, excerpt, old_version, new_version, update_url, pr_url, outcome, fingerprint, notified)
+    VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)`,
+		ap, l.Date, logURL(ap, l.Date), status, l.Category, l.Rule, strings.Join(l.Matches, "\n"), l.Excerpt,
+		l.OldVersion, l.NewVersion, l.UpdateURL, l.PRURL, l.Outcome, l.Fingerprint, kind == noticeFailure || kind == noticeReminder); err != nil {
+		fatal(err)
+	}
+
+	switch kind {
+	case noticeFailure, noticeReminder:
+		out.add(ctx, kind, ap, l)
+	case noticeFixed:
+		notifySubscribers(ctx, kind, ap, l)
+	}
+
+	if l.Outcome == logparser.PROpened {
+		notifySubscribers(ctx, noticePR, ap, l)
+	}
+}
+
+// Given a package URL, it returns the state of its logs, fetching those newer than since.
 //
 // It works by:
 // - fetching package page
-// - finding latest log
-// - fetching latest log
+// - finding logs newer than since (at most maxNewLogs)
+// - fetching each of them
 //
-// Therefore, it makes 2 HTTP requests.
-func fetchLatestLogState(ctx context.Context, url string) (string, bool, error) {
-	// First HTTP request, returns URL of latest log
-	purl, err := fetchLatestLogURL(ctx, url)
+// Therefore, it makes 1 HTTP request, plus 1 per new log.
+func fetchNewLogs(ctx context.Context, url, since string) (logState, error) {
+	// First HTTP request, returns the dates of all logs
+	dates, err := fetchLogDates(ctx, url)
+	if err != nil {
+		return logState{}, err
+	}
+
+	var newDates []string
+	for _, d := range dates {
+		if d > since {
+			newDates = append(newDates, d)
+		}
+	}
+	newDates = newDates[max(len(newDates)-maxNewLogs, 0):]
+
+	state := logState{History: dates}
+	for _, date := range newDates {
+		l, err := fetchLog(ctx, fmt.Sprintf("%s/%s.log", url, date))
+		if err != nil {
+			return logState{}, err
+		}
+
+		state.Logs = append(state.Logs, l)
+	}
+
+	return state, nil
+}
+
+// Given the URL of a log, it fetches it and checks it for errors.
+func fetchLog(ctx context.Context, url string) (logEntry, error) {
+	slog.Debug("fetching log", "url", url)
+
+	// Logs never change once written, so they aren't cached, but streamed
+	// through the scanner instead.
+	req, err := newReqWithUA(ctx, url)
 	if err != nil {
-		return "", false, err
+		return logEntry{}, err
 	}
 
-	slog.Debug("fetching log", "url", purl)
+	resp, err := doRequest(req)
+	if err != nil {
+		return logEntry{}, err
+	}
+	defer resp.Body.Close()
 
-	body, err := makeRequest(ctx, purl)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := readBody(resp)
+
+		return logEntry{}, &HTTPError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	l, err := scanLog(resp.Body)
 	if err != nil {
-		return "", false, err
+		return logEntry{}, &TransportError{URL: url, Err: err}
 	}
+	l.Date = getDate(url)
 
-	return getDate(purl), regexes.Error().Match(body), nil
+	return l, nil
 }
 
-// Given the URL of a package, it returns the URL of the latest log.
+// Given the URL of a package, it returns the dates of all of its logs, oldest first.
 //
-// It does this by parsing the fetched HTML and getting the latest link.
+// It does this by parsing the fetched HTML and getting the log links.
 //
 // Therefore, it makes 1 HTTP request.
-func fetchLatestLogURL(ctx context.Context, url string) (string, error) {
+func fetchLogDates(ctx context.Context, url string) ([]string, error) {
 	body, err := makeRequest(ctx, url)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	doc, err := html.Parse(bytes.NewReader(body))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	n := htmlquery.FindOne(doc, "//a[contains(@href, '.log')][last()]/@href")
-	href := htmlquery.InnerText(n)
+	var dates []string
+	for _, n := range htmlquery.Find(doc, "//a[contains(@href, '.log')]/@href") {
+		dates = append(dates, getDate(htmlquery.InnerText(n)))
+	}
+	slices.Sort(dates)
 
-	return fmt.Sprintf("%s/%s", url, href), nil
+	return dates, nil
 }
 
 // Given a URL of a package, it returns the date of the latest log.
 func fetchLatestLogDate(ctx context.Context, url string) (string, error) {
 	slog.Debug("fetching latest log date", "url", url)
-	lurl, err := fetchLatestLogURL(ctx, url)
+	dates, err := fetchLogDates(ctx, url)
 	if err != nil {
 		return "", err
 	}
-
-	return getDate(lurl), nil
-}
-
-func notifySubscribers(ctx context.Context, attr_path, date string) {
-	// - find all subscribers for package
-	// - send message in respective room
-	// - if we're not in that room, drop from db of subs?
-	logPath := fmt.Sprintf("%s/%s/%s.log", *mainURL, attr_path, date)
-	slog.Debug("lp", "lp", logPath)
-	rows, err := clients.db.QueryContext(ctx, "SELECT roomid FROM subscriptions WHERE attr_path = ?", attr_path)
-	if err != nil {
-		panic(err)
-	}
-	defer rows.Close()
-
-	roomIDs := make([]string, 0)
-	for rows.Next() {
-		var roomID string
-		if err := rows.Scan(&roomID); err != nil {
-			panic(err)
-		}
-		roomIDs = append(roomIDs, roomID)
-	}
-	if err := rows.Err(); err != nil {
-		panic(err)
+	if len(dates) == 0 {
+		return "", &NoLogsError{URL: url}
 	}
 
-	for _, roomID := range roomIDs {
-		slog.Info("notifying subscriber", "roomid", roomID)
-		s := fmt.Sprintf("New build error for package `%s`: %s", attr_path, logPath)
-		if _, err := h.sender(ctx, s, id.RoomID(roomID)); err != nil {
-			// TODO check if we're not in room, in that case remove sub
-			slog.Error(err.Error())
-		}
-	}
+	return dates[len(dates)-1], nil
 }
 
 // Decides what to do, based on the message content.
@@ -352,6 +634,22 @@ Type **help** for a list of allowed/forbidden patterns.`
 		handleFollowUnfollow(ctx, msg, evt)
 	} else if msg == "subs" {
 		handleSubs(ctx, evt)
+	} else if regexes.Status().MatchString(msg) {
+		handleStatus(ctx, msg, evt)
+	} else if regexes.Search().MatchString(msg) {
+		handleSearch(ctx, msg, evt)
+	} else if regexes.Mute().MatchString(msg) {
+		handleMute(ctx, msg, evt)
+	} else if regexes.Feedback().MatchString(msg) {
+		handleFeedback(ctx, msg, evt)
+	} else if msg == "report" && isAdmin(evt.Sender) {
+		handleReport(ctx, evt)
+	} else if regexes.Notify().MatchString(msg) {
+		handleNotify(ctx, msg, evt)
+	} else if regexes.Digest().MatchString(msg) {
+		handleDigest(ctx, msg, evt)
+	} else if regexes.Filter().MatchString(msg) {
+		handleFilter(ctx, msg, evt)
 	} else {
 		// anything else, so print help
 		if _, err := h.sender(ctx, helpText, evt.RoomID); err != nil {
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
+	"github.com/asymmetric/nixpkgs-update-notifier/logparser"
+)
+
+func TestUpdateSubs(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	aps := []string{"a", "b", "c", "d", "e", "f", "g"}
+	addPackages(aps...)
+
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "1999", nil
+		},
+		sender: testSender,
+	}
+	for _, ap := range aps {
+		sub(ap)
+	}
+
+	var sent []string
+	h = handlers{
+		logFetcher: func(ctx context.Context, url, since string) (logState, error) {
+			// only some packages have an error
+			category := classifier.Success
+			if strings.HasSuffix(url, "/a") || strings.HasSuffix(url, "/c") || strings.HasSuffix(url, "/g") {
+				category = classifier.BuildError
+			}
+
+			return logState{
+				Logs: []logEntry{{
+					Date:     "2000",
+					Category: category,
+				}},
+			}, nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	defer func(n int) { *updateWorkers = n }(*updateWorkers)
+	*updateWorkers = 3
+	updateSubs(ctx)
+
+	expected := []string{
+		"New build error for package `a`: https://nixpkgs-update-logs.nix-community.org/a/2000.log",
+		"New build error for package `c`: https://nixpkgs-update-logs.nix-community.org/c/2000.log",
+		"New build error for package `g`: https://nixpkgs-update-logs.nix-community.org/g/2000.log",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %v\ngot: %v", expected, sent)
+	}
+
+	var count int
+	if err := clients.db.QueryRow("SELECT COUNT(*) FROM packages WHERE last_visited = ?", "2000").Scan(&count); err != nil {
+		panic(err)
+	}
+	if count != len(aps) {
+		t.Errorf("expected %d packages to have been visited, got %d", len(aps), count)
+	}
+
+	if err := clients.db.QueryRow("SELECT COUNT(*) FROM logs WHERE status = ?", logStatusError).Scan(&count); err != nil {
+		panic(err)
+	}
+	if expected := 3; count != expected {
+		t.Errorf("expected %d failed logs, got %d", expected, count)
+	}
+
+	// a second run must not notify again
+	sent = nil
+	updateSubs(ctx)
+	if len(sent) != 0 {
+		t.Errorf("expected no notifications, got: %v", sent)
+	}
+}
+
+func TestStoreAttrPathsSkipsUnmodified(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	defer func(b bool) { *httpCache = b }(*httpCache)
+	*httpCache = false
+
+	staleMtime := "10-Dec-2024 03:14"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><h1>Index of /</h1><hr><pre><a href="../">../</a>
+<a href="fresh/">fresh/</a>                                    11-Dec-2024 00:30       -
+<a href="stale/">stale/</a>                                    ` + staleMtime + `       -
+<a href="unknown/">unknown/</a>
+</pre><hr></body></html>`))
+	}))
+	defer srv.Close()
+
+	storeAttrPaths(ctx, srv.URL)
+
+	var lm string
+	if err := clients.db.QueryRow("SELECT last_modified FROM packages WHERE attr_path = ?", "stale").Scan(&lm); err != nil {
+		panic(err)
+	}
+	if expected := "2024-12-10 03:14"; lm != expected {
+		t.Errorf("expected: %s; got: %s", expected, lm)
+	}
+
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2024-12-10", nil
+		},
+		sender: testSender,
+	}
+	for _, ap := range []string{"fresh", "stale", "unknown"} {
+		sub(ap)
+	}
+
+	var fetched []string
+	h.logFetcher = func(ctx context.Context, url, since string) (logState, error) {
+		fetched = append(fetched, url)
+		return logState{}, nil
+	}
+
+	defer func(n int) { *updateWorkers = n }(*updateWorkers)
+	*updateWorkers = 1
+	updateSubs(ctx)
+
+	// packages that were never checked are checked once
+	expected := []string{packageURL("fresh"), packageURL("stale"), packageURL("unknown")}
+	if !slices.Equal(expected, fetched) {
+		t.Errorf("expected: %v\ngot: %v", expected, fetched)
+	}
+
+	// fresh was modified after the day of its last log, but not since it was checked
+	fetched = nil
+	updateSubs(ctx)
+	if len(fetched) != 0 {
+		t.Errorf("expected no packages to be checked, got: %v", fetched)
+	}
+
+	staleMtime = "12-Dec-2024 09:00"
+	storeAttrPaths(ctx, srv.URL)
+
+	fetched = nil
+	updateSubs(ctx)
+	if expected := []string{packageURL("stale")}; !slices.Equal(expected, fetched) {
+		t.Errorf("expected: %v\ngot: %v", expected, fetched)
+	}
+
+	// unmodified packages are still checked when they're due
+	if _, err := clients.db.Exec("UPDATE packages SET next_check = datetime('now', '-1 minute') WHERE attr_path = ?", "fresh"); err != nil {
+		panic(err)
+	}
+
+	fetched = nil
+	updateSubs(ctx)
+	if expected := []string{packageURL("fresh")}; !slices.Equal(expected, fetched) {
+		t.Errorf("expected: %v\ngot: %v", expected, fetched)
+	}
+}
+
+func TestStoreAttrPathsNotModified(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`<html><body><pre><a href="foo/">foo/</a>                                    11-Dec-2024 08:00       -
+</pre></body></html>`))
+	}))
+	defer srv.Close()
+
+	if !storeAttrPaths(ctx, srv.URL) {
+		t.Error("expected packages to be updated")
+	}
+
+	if _, err := clients.db.Exec("DELETE FROM packages"); err != nil {
+		panic(err)
+	}
+
+	if storeAttrPaths(ctx, srv.URL) {
+		t.Error("expected packages not to be updated")
+	}
+
+	var count int
+	if err := clients.db.QueryRow("SELECT COUNT(*) FROM packages").Scan(&count); err != nil {
+		panic(err)
+	}
+	if count != 0 {
+		t.Errorf("expected the unchanged page not to be parsed, got %d packages", count)
+	}
+}
+
+func TestFixedNotice(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	addPackages("foo")
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		sender: captureSender(&sent),
+	}
+	sub("foo")
+
+	logs := []logEntry{
+		{Date: "2000-01-02", Category: classifier.BuildError},
+		{Date: "2000-01-03", Category: classifier.Success},
+		{Date: "2000-01-04", Category: classifier.BuildError},
+		{Date: "2000-01-05", Category: classifier.Success},
+	}
+
+	for i, l := range logs {
+		// opt in halfway through
+		if i == 2 {
+			notify("fixed on")
+		}
+
+		sent = nil
+		var out outbox
+		handleLogResult(ctx, logResult{attrPath: "foo", state: logState{Logs: []logEntry{l}}}, &out)
+		out.flush(ctx)
+
+		fixed := slices.ContainsFunc(sent, func(s string) bool { return strings.Contains(s, "builds again") })
+		if expected := i == 3; fixed != expected {
+			t.Errorf("log %s: expected fixed notice: %v; got: %v", l.Date, expected, sent)
+		}
+	}
+}
+
+func TestFetchNewLogs(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<a href="../">../</a>
+<a href="2024-12-08.log">2024-12-08.log</a>
+<a href="2024-12-10.log">2024-12-10.log</a>
+<a href="2024-12-09.log">2024-12-09.log</a>`))
+	})
+	mux.HandleFunc("/foo/2024-12-09.log", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("error: hash mismatch\n"))
+	})
+	mux.HandleFunc("/foo/2024-12-10.log", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("all good\n"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	state, err := fetchNewLogs(ctx, srv.URL+"/foo", "2024-12-08")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"2024-12-08", "2024-12-09", "2024-12-10"}; !slices.Equal(expected, state.History) {
+		t.Errorf("expected: %v\ngot: %v", expected, state.History)
+	}
+
+	expected := []logEntry{
+		{Date: "2024-12-09", Category: classifier.BuildError, Matches: []string{"error: hash mismatch"}},
+		{Date: "2024-12-10", Category: classifier.Success},
+	}
+	if len(state.Logs) != len(expected) {
+		t.Fatalf("expected: %v\ngot: %v", expected, state.Logs)
+	}
+	for i, l := range state.Logs {
+		if l.Date != expected[i].Date || l.Category != expected[i].Category || !slices.Equal(l.Matches, expected[i].Matches) {
+			t.Errorf("expected: %v\ngot: %v", expected[i], l)
+		}
+	}
+}
+
+func TestUpdateSubsMultipleNewLogs(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	addPackages("foo")
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		logFetcher: func(ctx context.Context, url, since string) (logState, error) {
+			return logState{Logs: []logEntry{
+				{Date: "2000-01-01", Category: classifier.BuildError},
+				{Date: "2000-01-02", Category: classifier.BuildError},
+				{Date: "2000-01-03", Category: classifier.Success},
+				{Date: "2000-01-04", Category: classifier.BuildError},
+			}}, nil
+		},
+		sender: captureSender(&sent),
+	}
+	sub("foo")
+	sent = nil
+
+	updateSubs(ctx)
+
+	// the first log predates the subscription
+	expected := []string{
+		"New build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-02.log",
+		"New build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-04.log",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %v\ngot: %v", expected, sent)
+	}
+
+	var lv string
+	if err := clients.db.QueryRow("SELECT last_visited FROM packages WHERE attr_path = ?", "foo").Scan(&lv); err != nil {
+		panic(err)
+	}
+	if expected := "2000-01-04"; lv != expected {
+		t.Errorf("expected: %s; got: %s", expected, lv)
+	}
+}
+
+func TestPRNotice(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	addPackages("foo")
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		sender: captureSender(&sent),
+	}
+	sub("foo")
+	notify("pr on")
+	sent = nil
+
+	l, err := scanLog(strings.NewReader("foo 1.0 -> 1.1\nhttps://github.com/NixOS/nixpkgs/pull/123456\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Date = "2000-01-02"
+	handleLogResult(ctx, logResult{attrPath: "foo", state: logState{Logs: []logEntry{l}}}, &outbox{})
+
+	expected := []string{"Pull request opened for package `foo` (1.0 → 1.1): https://github.com/NixOS/nixpkgs/pull/123456\n\nLog: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-02.log"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	var outcome, newVersion string
+	if err := clients.db.QueryRow("SELECT outcome, new_version FROM logs WHERE attr_path = ?", "foo").Scan(&outcome, &newVersion); err != nil {
+		panic(err)
+	}
+	if outcome != string(logparser.PROpened) || newVersion != "1.1" {
+		t.Errorf("unexpected outcome %s and version %s", outcome, newVersion)
+	}
+}
+
+func TestRepeatedFailure(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	addPackages("foo")
+
+	defer func(d time.Duration) { *notifyRemind = d }(*notifyRemind)
+	*notifyRemind = 72 * time.Hour
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		logFetcher: func(ctx context.Context, url, since string) (logState, error) {
+			return logState{Logs: []logEntry{
+				{Date: "2000-01-02", Category: classifier.BuildError, Fingerprint: "a"},
+				{Date: "2000-01-03", Category: classifier.BuildError, Fingerprint: "a"},
+				{Date: "2000-01-04", Category: classifier.BuildError, Fingerprint: "b"},
+				{Date: "2000-01-05", Category: classifier.BuildError, Fingerprint: "b"},
+				{Date: "2000-01-07", Category: classifier.BuildError, Fingerprint: "b"},
+				{Date: "2000-01-08", Category: classifier.Success},
+				{Date: "2000-01-09", Category: classifier.BuildError, Fingerprint: "b"},
+			}}, nil
+		},
+		sender: captureSender(&sent),
+	}
+	sub("foo")
+	sent = nil
+
+	updateSubs(ctx)
+
+	expected := []string{
+		"New build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-02.log",
+		"New build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-04.log",
+		"Package `foo` still fails with the same build error: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-07.log",
+		"New build error for package `foo`: https://nixpkgs-update-logs.nix-community.org/foo/2000-01-09.log",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %v\ngot: %v", expected, sent)
+	}
+}
+
+func TestFailureCluster(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	aps := []string{"a", "b", "c", "d"}
+	addPackages(aps...)
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "1999", nil
+		},
+		logFetcher: func(ctx context.Context, url, since string) (logState, error) {
+			l := logEntry{
+				Date:        "2000",
+				Category:    classifier.BuildError,
+				Matches:     []string{"error: dependency bar failed"},
+				Fingerprint: "bar",
+			}
+			if strings.HasSuffix(url, "/c") {
+				l.Matches = []string{"error: something else"}
+				l.Fingerprint = "c"
+			}
+
+			return logState{Logs: []logEntry{l}}, nil
+		},
+		sender: captureSender(&sent),
+	}
+	for _, ap := range aps {
+		sub(ap)
+	}
+	sent = nil
+
+	updateSubs(ctx)
+
+	expected := []string{
+		"3 packages failing with the same build error:\n\n```\nerror: dependency bar failed\n```\n" +
+			"\n- `a`: https://nixpkgs-update-logs.nix-community.org/a/2000.log" +
+			"\n- `b`: https://nixpkgs-update-logs.nix-community.org/b/2000.log" +
+			"\n- `d`: https://nixpkgs-update-logs.nix-community.org/d/2000.log",
+		"New build error for package `c`: https://nixpkgs-update-logs.nix-community.org/c/2000.log",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+}
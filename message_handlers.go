@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
 	"github.com/asymmetric/nixpkgs-update-notifier/regexes"
 	"github.com/itchyny/gojq"
 	"maunium.net/go/mautrix"
@@ -31,59 +38,455 @@ func handleSubUnsub(ctx context.Context, msg string, evt *event.Event) {
 		return
 	}
 
-	pattern := matches[2]
+	patterns := splitPatterns(matches[2])
 
 	// matches[1] is the optional "un" prefix
 	if matches[1] != "" {
-		handleUnsub(ctx, pattern, evt)
+		handleUnsub(ctx, patterns, evt)
 	} else {
-		handleSub(ctx, pattern, evt)
+		handleSub(ctx, patterns, evt)
 	}
 }
 
-func handleUnsub(ctx context.Context, pattern string, evt *event.Event) {
-	rows, err := clients.db.QueryContext(ctx, "DELETE FROM subscriptions WHERE roomid = ? AND attr_path GLOB ? RETURNING attr_path", evt.RoomID, pattern)
-	if err != nil {
-		panic(err)
+// Splits a space- or comma-separated list of patterns, dropping duplicates.
+func splitPatterns(s string) []string {
+	var patterns []string
+	for _, p := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if !slices.Contains(patterns, p) {
+			patterns = append(patterns, p)
+		}
 	}
-	defer rows.Close()
 
-	var aps []string
-	for rows.Next() {
-		var ap string
-		if err := rows.Scan(&ap); err != nil {
+	return patterns
+}
+
+func handleUnsub(ctx context.Context, patterns []string, evt *event.Event) {
+	var aps, notFound []string
+	for _, pattern := range patterns {
+		rows, err := clients.db.QueryContext(ctx, "DELETE FROM subscriptions WHERE roomid = ? AND attr_path GLOB ? RETURNING attr_path, rule_id", evt.RoomID, pattern)
+		if err != nil {
 			panic(err)
 		}
 
-		aps = append(aps, ap)
+		var n int
+		// subscriptions added by rules, by attr path
+		excluded := make(map[string]int64)
+		for rows.Next() {
+			var ap string
+			var ruleID sql.NullInt64
+			if err := rows.Scan(&ap, &ruleID); err != nil {
+				panic(err)
+			}
+
+			aps = append(aps, ap)
+			if ruleID.Valid {
+				excluded[ap] = ruleID.Int64
+			}
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			panic(err)
+		}
+		rows.Close()
+
+		// so that their rules don't subscribe to them again
+		for ap, ruleID := range excluded {
+			if _, err := clients.db.ExecContext(ctx, "INSERT OR IGNORE INTO rule_exclusions(rule_id, attr_path) VALUES (?, ?)", ruleID, ap); err != nil {
+				panic(err)
+			}
+		}
+
+		if isGlob(pattern) {
+			if err := deleteCoveredGlobRules(ctx, evt.RoomID.String(), pattern); err != nil {
+				panic(err)
+			}
+		}
+
+		if n == 0 {
+			notFound = append(notFound, fmt.Sprintf("`%s`", pattern))
+		}
 	}
-	if err := rows.Err(); err != nil {
+	slices.Sort(aps)
+
+	var parts []string
+	if len(aps) > 0 {
+		parts = append(parts, fmt.Sprintf("Unsubscribed from packages:\n %s", strings.Join(formatPackageList(aps), "\n")))
+	}
+	if len(notFound) > 0 {
+		parts = append(parts, fmt.Sprintf("Could not find subscriptions for pattern %s", strings.Join(notFound, ", ")))
+	}
+	msg := strings.Join(parts, "\n\n")
+
+	// send confirmation message
+	if _, err := h.sender(ctx, msg, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+
+		if errors.Is(err, mautrix.MTooLarge) {
+			if _, err := h.sender(ctx, fmt.Sprintf("Unsubscribed from %d packages", len(aps)), evt.RoomID); err != nil {
+				slog.Error(err.Error())
+			}
+		}
+	}
+
+	slog.Info("received unsub", "patterns", patterns, "sender", evt.Sender, "deleted", len(aps))
+}
+
+// Subscribes to the packages matching patterns. Globs are stored as rules, so
+// that packages matching them later are subscribed to as well.
+func handleSub(ctx context.Context, patterns []string, evt *event.Event) {
+	var aps, noMatches []string
+	// the rule each package is subscribed to because of, if any
+	ruleIDs := make(map[string]int64)
+	for _, pattern := range patterns {
+		matches, err := matchPackages(ctx, pattern)
+		if err != nil {
+			panic(err)
+		}
+
+		slog.Info("received sub", "pattern", pattern, "sender", evt.Sender, "matches", len(matches))
+
+		if len(matches) == 0 {
+			noMatches = append(noMatches, fmt.Sprintf("`%s`", pattern))
+
+			continue
+		}
+
+		var ruleID int64
+		if isGlob(pattern) {
+			if ruleID, err = saveRule(ctx, rule{roomid: evt.RoomID.String(), mxid: evt.Sender.String(), kind: ruleGlob, value: pattern}); err != nil {
+				panic(err)
+			}
+		}
+
+		for _, ap := range matches {
+			if !slices.Contains(aps, ap) {
+				aps = append(aps, ap)
+				ruleIDs[ap] = ruleID
+			}
+		}
+	}
+
+	var esErr existingSubscriptionError
+	var httpErr *HTTPError
+	var noLogsErr *NoLogsError
+
+	var subscribed, existing, noLogs, failed []string
+	for _, ap := range aps {
+		// TODO: should we notify here already if the log has an error?
+		if err := addSubscription(ctx, ap, evt.RoomID.String(), evt.Sender.String(), ruleIDs[ap]); err != nil {
+			if errors.As(err, &esErr) {
+				existing = append(existing, ap)
+			} else if errors.As(err, &noLogsErr) {
+				noLogs = append(noLogs, ap)
+			} else if errors.As(err, &httpErr) {
+				slog.Warn("HTTP error while subscribing to package", "ap", ap, "error", httpErr.StatusCode)
+				failed = append(failed, ap)
+			} else if isNetworkError(err) {
+				slog.Warn("network error while subscribing to package", "ap", ap, "error", err)
+				failed = append(failed, ap)
+			} else {
+				panic(err)
+			}
+
+			continue
+		}
+
+		slog.Info("added sub", "ap", ap, "sender", evt.Sender)
+		subscribed = append(subscribed, ap)
+	}
+
+	var parts []string
+	if len(subscribed) == 1 {
+		parts = append(parts, fmt.Sprintf("Subscribed to package `%s`", subscribed[0]))
+	} else if len(subscribed) > 1 {
+		parts = append(parts, fmt.Sprintf("Subscribed to packages:\n %s", strings.Join(formatPackageList(subscribed), "\n")))
+	}
+	if len(existing) > 0 {
+		parts = append(parts, existingSubscriptionError(strings.Join(existing, ", ")).Error())
+	}
+	if len(noLogs) > 0 {
+		parts = append(parts, fmt.Sprintf("Could not subscribe to packages without any logs yet:\n %s", strings.Join(formatPackageList(noLogs), "\n")))
+	}
+	if len(failed) > 0 {
+		parts = append(parts, fmt.Sprintf("Could not subscribe to packages, please try again later:\n %s", strings.Join(formatPackageList(failed), "\n")))
+	}
+	if len(noMatches) > 0 {
+		parts = append(parts, fmt.Sprintf("No matches for %s. The list of packages is [here](https://nixpkgs-update-logs.nix-community.org/)", strings.Join(noMatches, ", ")))
+	}
+	msg := strings.Join(parts, "\n\n")
+
+	if _, err := h.sender(ctx, msg, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+
+		if errors.Is(err, mautrix.MTooLarge) {
+			if _, err := h.sender(ctx, fmt.Sprintf("Subscribed to %d packages", len(subscribed)), evt.RoomID); err != nil {
+				slog.Error(err.Error())
+			}
+		}
+	}
+}
+
+// Maximum number of packages shown by the status command.
+var statusLimit = 10
+
+// Replies with the latest log checked for the packages matching a pattern,
+// without subscribing to them.
+func handleStatus(ctx context.Context, msg string, evt *event.Event) {
+	pattern := regexes.Status().FindStringSubmatch(msg)[1]
+
+	aps, err := matchPackages(ctx, pattern)
+	if err != nil {
 		panic(err)
 	}
 
-	var msg string
+	slog.Info("received status", "pattern", pattern, "sender", evt.Sender, "matches", len(aps))
+
+	var reply string
 	if len(aps) == 0 {
-		msg = fmt.Sprintf("Could not find subscriptions for pattern `%s`", pattern)
+		reply = fmt.Sprintf("No matches for `%s`. The list of packages is [here](https://nixpkgs-update-logs.nix-community.org/)", pattern)
 	} else {
-		msg = fmt.Sprintf("Unsubscribed from packages:\n %s", strings.Join(formatPackageList(aps), "\n"))
+		shown := aps[:min(len(aps), statusLimit)]
+		maintainers := findMaintainers(shown)
+
+		// packages nobody is subscribed to aren't checked by updateSubs, so any
+		// logs stored for them may be outdated, and their latest log is fetched
+		// now instead
+		var unchecked []string
+		for _, ap := range shown {
+			var exists bool
+			if err := clients.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM subscriptions WHERE attr_path = ?)", ap).Scan(&exists); err != nil {
+				panic(err)
+			}
+			if !exists {
+				unchecked = append(unchecked, ap)
+			}
+		}
+		fetched := fetchLatestLogs(ctx, unchecked)
+
+		lines := []string{
+			"| Package | Latest log | Verdict | Maintainers | Subscribed |",
+			"| --- | --- | --- | --- | --- |",
+		}
+		for _, ap := range shown {
+			log, verdict := "not checked yet", "-"
+			if res, ok := fetched[ap]; ok {
+				var noLogsErr *NoLogsError
+				switch {
+				case errors.As(res.err, &noLogsErr):
+					log = "no logs yet"
+				case res.err != nil:
+					slog.Warn("fetching latest log", "ap", ap, "err", res.err)
+					log = "could not be fetched"
+				default:
+					l := res.state.Logs[len(res.state.Logs)-1]
+					status := logStatusOK
+					if l.Category.Failed() {
+						status = logStatusError
+					}
+					log = fmt.Sprintf("[%s](%s)", l.Date, logURL(ap, l.Date))
+					verdict = fmt.Sprintf("%s (%s)", status, l.Category.Description())
+				}
+			} else {
+				var date, url, status string
+				var category sql.NullString
+				err := clients.db.QueryRowContext(ctx, "SELECT date, url, status, category FROM logs WHERE attr_path = ? ORDER BY date DESC LIMIT 1", ap).Scan(&date, &url, &status, &category)
+				if err != nil && !errors.Is(err, sql.ErrNoRows) {
+					panic(err)
+				}
+				if err == nil {
+					log = fmt.Sprintf("[%s](%s)", date, url)
+					verdict = status
+					if category.Valid {
+						verdict = fmt.Sprintf("%s (%s)", status, classifier.Category(category.String).Description())
+					}
+				}
+			}
+
+			subscribed, err := checkIfSubExists(ctx, ap, evt.RoomID.String())
+			if err != nil {
+				panic(err)
+			}
+			yesNo := "no"
+			if subscribed {
+				yesNo = "yes"
+			}
+
+			ms := "-"
+			if len(maintainers[ap]) > 0 {
+				ms = strings.Join(maintainers[ap], ", ")
+			}
+
+			lines = append(lines, fmt.Sprintf("| `%s` | %s | %s | %s | %s |", ap, log, verdict, ms, yesNo))
+		}
+		if len(aps) > len(shown) {
+			lines = append(lines, "", fmt.Sprintf("...and %d more packages, use a more specific pattern to see them.", len(aps)-len(shown)))
+		}
+
+		reply = strings.Join(lines, "\n")
 	}
 
-	// send confirmation message
-	if _, err := h.sender(ctx, msg, evt.RoomID); err != nil {
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
 		slog.Error(err.Error())
 	}
+}
+
+// Fetches the latest log of each package concurrently, by attr path, without
+// storing it.
+func fetchLatestLogs(ctx context.Context, aps []string) map[string]logResult {
+	results := make([]logResult, len(aps))
+
+	var wg sync.WaitGroup
+	for i, ap := range aps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			state, err := fetchLatestLog(ctx, ap)
+			results[i] = logResult{attrPath: ap, state: state, err: err}
+		}()
+	}
+	wg.Wait()
+
+	m := make(map[string]logResult, len(results))
+	for _, res := range results {
+		m[res.attrPath] = res
+	}
 
-	slog.Info("received unsub", "pkg", pattern, "sender", evt.Sender, "deleted", len(aps))
+	return m
 }
 
-func handleSub(ctx context.Context, pattern string, evt *event.Event) {
-	rows, err := clients.db.QueryContext(ctx, "SELECT attr_path FROM packages WHERE attr_path GLOB ? ORDER BY attr_path", pattern)
+// Fetches only the latest log of a package, which is returned as the last one
+// of the state's logs.
+func fetchLatestLog(ctx context.Context, ap string) (logState, error) {
+	date, err := h.dateFetcher(ctx, packageURL(ap))
+	if err != nil {
+		return logState{}, err
+	}
+	t, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		return logState{}, fmt.Errorf("invalid log date %q for %s: %w", date, ap, err)
+	}
+
+	// there's at most one log per day, so this only fetches the latest one
+	state, err := h.logFetcher(ctx, packageURL(ap), t.AddDate(0, 0, -1).Format(time.DateOnly))
+	if err != nil {
+		return logState{}, err
+	}
+	if len(state.Logs) == 0 {
+		return logState{}, &NoLogsError{URL: packageURL(ap)}
+	}
+
+	return state, nil
+}
+
+// Returns the GitHub handles of the maintainers of packages, according to the
+// JSON blob.
+func findMaintainers(aps []string) map[string][]string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	packages, _ := jsblob["packages"].(map[string]any)
+
+	maintainers := make(map[string][]string)
+	for key, v := range packages {
+		// the JSON blob has denormalized attr paths, e.g. python312Packages.foo
+		ap := regexes.NormalizeAttrPath(key)
+		if !slices.Contains(aps, ap) {
+			continue
+		}
+
+		pkg, _ := v.(map[string]any)
+		meta, _ := pkg["meta"].(map[string]any)
+		ms, _ := meta["maintainers"].([]any)
+		for _, m := range ms {
+			m, _ := m.(map[string]any)
+			if handle, ok := m["github"].(string); ok && !slices.Contains(maintainers[ap], handle) {
+				maintainers[ap] = append(maintainers[ap], handle)
+			}
+		}
+	}
+
+	for _, ms := range maintainers {
+		slices.Sort(ms)
+	}
+
+	return maintainers
+}
+
+// Number of packages per page of search results.
+const searchPageSize = 20
+
+// Lists the packages matching a query, a page at a time, so that patterns can
+// be tried out before subscribing.
+func handleSearch(ctx context.Context, msg string, evt *event.Event) {
+	matches := regexes.Search().FindStringSubmatch(msg)
+	query := matches[1]
+	page := 1
+	if matches[2] != "" {
+		page, _ = strconv.Atoi(matches[2])
+	}
+
+	slog.Info("received search", "query", query, "page", page, "sender", evt.Sender)
+
+	var reply string
+	aps, err := searchPackages(ctx, query)
+	if err != nil {
+		reply = fmt.Sprintf("Invalid regex `%s`: %s", query, err)
+	} else if len(aps) == 0 {
+		reply = fmt.Sprintf("No matches for `%s`. The list of packages is [here](https://nixpkgs-update-logs.nix-community.org/)", query)
+	} else {
+		pages := (len(aps) + searchPageSize - 1) / searchPageSize
+		page = min(max(page, 1), pages)
+		shown := aps[(page-1)*searchPageSize : min(page*searchPageSize, len(aps))]
+
+		reply = fmt.Sprintf("%d packages match `%s`", len(aps), query)
+		if pages > 1 {
+			reply += fmt.Sprintf(" (page %d of %d)", page, pages)
+		}
+		reply += fmt.Sprintf(":\n\n%s", strings.Join(formatPackageList(shown), "\n"))
+		if page < pages {
+			reply += fmt.Sprintf("\n\nType **search %s %d** for more.", query, page+1)
+		}
+	}
+
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// Returns the tracked packages matching a search query, which is either a
+// regex between slashes, a glob, or a substring to look for (ignoring case).
+func searchPackages(ctx context.Context, query string) ([]string, error) {
+	if len(query) > 2 && strings.HasPrefix(query, "/") && strings.HasSuffix(query, "/") {
+		re, err := regexp.Compile(query[1 : len(query)-1])
+		if err != nil {
+			return nil, err
+		}
+
+		all, err := matchPackages(ctx, "*")
+		if err != nil {
+			panic(err)
+		}
+
+		return slices.DeleteFunc(all, func(ap string) bool { return !re.MatchString(ap) }), nil
+	}
+
+	if isGlob(query) {
+		aps, err := matchPackages(ctx, query)
+		if err != nil {
+			panic(err)
+		}
+
+		return aps, nil
+	}
+
+	rows, err := clients.db.QueryContext(ctx, "SELECT attr_path FROM packages WHERE instr(lower(attr_path), lower(?)) > 0 ORDER BY attr_path", query)
 	if err != nil {
 		panic(err)
 	}
 	defer rows.Close()
 
-	aps := make([]string, 0)
+	var aps []string
 	for rows.Next() {
 		var ap string
 		if err := rows.Scan(&ap); err != nil {
@@ -95,50 +498,66 @@ func handleSub(ctx context.Context, pattern string, evt *event.Event) {
 		panic(err)
 	}
 
-	slog.Info("received sub", "pattern", pattern, "sender", evt.Sender, "matches", len(aps))
+	return aps, nil
+}
 
-	if len(aps) == 0 {
-		if _, err = h.sender(ctx, fmt.Sprintf("No matches for `%s`. The list of packages is [here](https://nixpkgs-update-logs.nix-community.org/)", pattern), evt.RoomID); err != nil {
-			slog.Error(err.Error())
-		}
+// Returns the tracked packages matching a glob pattern.
+func matchPackages(ctx context.Context, pattern string) ([]string, error) {
+	rows, err := clients.db.QueryContext(ctx, "SELECT attr_path FROM packages WHERE attr_path GLOB ? ORDER BY attr_path", pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		return
+	var aps []string
+	for rows.Next() {
+		var ap string
+		if err := rows.Scan(&ap); err != nil {
+			return nil, err
+		}
+		aps = append(aps, ap)
 	}
 
-	var esErr existingSubscriptionError
-	var httpErr *HTTPError
+	return aps, rows.Err()
+}
 
-	for _, ap := range aps {
-		// TODO: should we notify here already if the log has an error?
-		if err := subscribe(ctx, ap, evt); err != nil {
-			if errors.As(err, &esErr) {
-				if _, err := h.sender(ctx, esErr.Error(), evt.RoomID); err != nil {
-					slog.Error(err.Error())
-				}
+// Returns whether a pattern can match more than one package.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
 
-				// skip this ap
-				continue
-			} else if errors.As(err, &httpErr) {
-				slog.Warn("HTTP error while subscribing to package", "ap", ap, "error", httpErr.StatusCode)
+// Lists the room's subscriptions, with those added by rules under their rule.
+func handleSubs(ctx context.Context, evt *event.Event) {
+	rules, err := listRules(ctx, evt.RoomID.String(), ruleGlob, ruleMaintainer, ruleTeam)
+	if err != nil {
+		panic(err)
+	}
 
-				continue
-			} else {
-				panic(err)
-			}
-		}
+	muted, err := muteStates(ctx, evt.RoomID.String())
+	if err != nil {
+		panic(err)
+	}
 
-		// send confirmation message
-		if _, err := h.sender(ctx, fmt.Sprintf("Subscribed to package `%s`", ap), evt.RoomID); err != nil {
-			slog.Error(err.Error())
+	var total int
+	var sections []string
+	for _, r := range rules {
+		aps, err := ruleSubscriptions(ctx, r.id, false)
+		if err != nil {
+			panic(err)
 		}
+		total += len(aps)
 
-		slog.Info("added sub", "ap", ap, "sender", evt.Sender)
+		section := fmt.Sprintf("- %s", r)
+		for _, ap := range aps {
+			section += fmt.Sprintf("\n  - `%s`%s", ap, muted[ap])
+		}
+		sections = append(sections, section)
+	}
+	if len(sections) > 0 {
+		sections = append([]string{"Your rules:\n"}, sections...)
 	}
-}
 
-// TODO find ways to test this
-func handleSubs(ctx context.Context, evt *event.Event) {
-	rows, err := clients.db.QueryContext(ctx, "SELECT attr_path FROM subscriptions WHERE roomid = ? ORDER BY attr_path", evt.RoomID)
+	rows, err := clients.db.QueryContext(ctx, "SELECT attr_path FROM subscriptions WHERE roomid = ? AND rule_id IS NULL ORDER BY attr_path", evt.RoomID)
 	if err != nil {
 		panic(err)
 	}
@@ -156,19 +575,30 @@ func handleSubs(ctx context.Context, evt *event.Event) {
 		panic(err)
 	}
 
+	total += len(mps)
+
 	var msg string
-	if len(mps) == 0 {
+	if total == 0 && len(rules) == 0 {
 		msg = "no subs"
 	} else {
-		subs := append([]string{"Your subscriptions:\n"}, formatPackageList(mps)...)
+		var subs []string
+		if len(mps) > 0 {
+			subs = []string{"Your subscriptions:\n"}
+			for i, item := range formatPackageList(mps) {
+				subs = append(subs, item+muted[mps[i]])
+			}
+		}
+		if len(subs) > 0 && len(sections) > 0 {
+			subs = append(subs, "")
+		}
 
-		msg = strings.Join(subs, "\n")
+		msg = strings.Join(append(subs, sections...), "\n")
 	}
 	if _, err = h.sender(ctx, msg, evt.RoomID); err != nil {
 		slog.Error(err.Error())
 
 		if errors.Is(err, mautrix.MTooLarge) {
-			msg = fmt.Sprintf("Subscribed to %d packages", len(mps))
+			msg = fmt.Sprintf("Subscribed to %d packages", total)
 
 			if _, err := h.sender(ctx, msg, evt.RoomID); err != nil {
 				slog.Error(err.Error())
@@ -177,19 +607,144 @@ func handleSubs(ctx context.Context, evt *event.Event) {
 	}
 }
 
+// The longest duration subscriptions can be muted for.
+const maxMuteDuration = 365 * 24 * time.Hour
+
+// Mutes or unmutes the room's subscriptions matching a pattern, for a duration
+// or until the package builds again.
+func handleMute(ctx context.Context, msg string, evt *event.Event) {
+	matches := regexes.Mute().FindStringSubmatch(msg)
+	un := matches[1] != ""
+	pattern := matches[2]
+	arg := strings.ToLower(matches[3])
+
+	d, validDuration := time.Duration(0), true
+	if arg != "" && arg != "until-fixed" {
+		d, validDuration = parseMuteDuration(arg)
+	}
+
+	var reply string
+	if un == (arg != "") {
+		reply = "Usage: **mute foo 7d**, **mute foo until-fixed** or **unmute foo**"
+	} else if !validDuration {
+		reply = "Packages can be muted for at most a year, or **until-fixed**"
+	} else {
+		var query, until string
+		args := []any{evt.RoomID, pattern}
+		switch {
+		case un:
+			query = "UPDATE subscriptions SET muted_until = NULL, muted_until_fixed = 0 WHERE roomid = ? AND attr_path GLOB ? RETURNING attr_path"
+		case arg == "until-fixed":
+			query = "UPDATE subscriptions SET muted_until = NULL, muted_until_fixed = 1 WHERE roomid = ? AND attr_path GLOB ? RETURNING attr_path"
+			until = "they build again"
+		default:
+			t := time.Now().UTC().Add(d)
+			query = "UPDATE subscriptions SET muted_until = ?, muted_until_fixed = 0 WHERE roomid = ? AND attr_path GLOB ? RETURNING attr_path"
+			args = append([]any{t.Format(time.DateTime)}, args...)
+			until = t.Format("2006-01-02 15:04") + " UTC"
+		}
+
+		rows, err := clients.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			panic(err)
+		}
+		defer rows.Close()
+
+		var aps []string
+		for rows.Next() {
+			var ap string
+			if err := rows.Scan(&ap); err != nil {
+				panic(err)
+			}
+			aps = append(aps, ap)
+		}
+		if err := rows.Err(); err != nil {
+			panic(err)
+		}
+		slices.Sort(aps)
+
+		list := strings.Join(formatPackageList(aps), "\n")
+		switch {
+		case len(aps) == 0:
+			reply = fmt.Sprintf("Could not find subscriptions for pattern `%s`", pattern)
+		case un:
+			reply = fmt.Sprintf("Unmuted packages:\n%s", list)
+		default:
+			reply = fmt.Sprintf("Muted packages until %s:\n%s", until, list)
+		}
+	}
+
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+
+	slog.Info("received mute", "msg", msg, "sender", evt.Sender)
+}
+
+// Parses durations like 12h, 7d or 2w, as matched by regexes.Mute. It returns
+// false if the duration is longer than maxMuteDuration.
+func parseMuteDuration(s string) (time.Duration, bool) {
+	unit := map[byte]time.Duration{'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}[s[len(s)-1]]
+	// checked before multiplying, which could overflow
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n > int(maxMuteDuration/unit) {
+		return 0, false
+	}
+
+	return time.Duration(n) * unit, true
+}
+
+// Returns a description of the mute state of the room's muted subscriptions,
+// by attr path, e.g. " (muted until they build again)".
+func muteStates(ctx context.Context, roomid string) (map[string]string, error) {
+	rows, err := clients.db.QueryContext(ctx, `
+    SELECT attr_path, muted_until, muted_until_fixed FROM subscriptions
+    WHERE roomid = ? AND (muted_until_fixed OR muted_until > datetime('now'))`, roomid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]string)
+	for rows.Next() {
+		var ap string
+		var until sql.NullString
+		var fixed bool
+		if err := rows.Scan(&ap, &until, &fixed); err != nil {
+			return nil, err
+		}
+
+		if fixed {
+			states[ap] = " (muted until it builds again)"
+		} else if t, err := time.Parse(time.DateTime, until.String); err == nil {
+			states[ap] = fmt.Sprintf(" (muted until %s UTC)", t.Format("2006-01-02 15:04"))
+		}
+	}
+
+	return states, rows.Err()
+}
+
 func handleFollowUnfollow(ctx context.Context, msg string, evt *event.Event) {
 	matches := regexes.Follow().FindStringSubmatch(msg)
 	un := matches[1]
-	handle := matches[2]
+	team := matches[2]
+	members := matches[3] != ""
+	handle := matches[4]
 
 	// Log early, before slow network calls.
 	if un == "" {
-		slog.Info("received follow", "handle", handle, "sender", evt.Sender)
+		slog.Info("received follow", "handle", handle, "team", team, "sender", evt.Sender)
 	} else {
-		slog.Info("received unfollow", "handle", handle, "sender", evt.Sender)
+		slog.Info("received unfollow", "handle", handle, "team", team, "sender", evt.Sender)
 	}
 
-	mps, err := findPackagesForHandle(ctx, handle)
+	var mps []string
+	var err error
+	if team != "" {
+		mps, err = findPackagesForTeam(ctx, team, members)
+	} else {
+		mps, err = findPackagesForHandle(ctx, handle)
+	}
 	if err != nil {
 		if _, err = h.sender(ctx, "There was a problem processing your request, sorry.", evt.RoomID); err != nil {
 			slog.Error(err.Error())
@@ -198,8 +753,38 @@ func handleFollowUnfollow(ctx context.Context, msg string, evt *event.Event) {
 		return
 	}
 
-	if len(mps) == 0 {
-		if _, err := h.sender(ctx, fmt.Sprintf("No packages found for maintainer `%s`", handle), evt.RoomID); err != nil {
+	r := rule{roomid: evt.RoomID.String(), mxid: evt.Sender.String(), kind: ruleMaintainer, value: handle}
+	if team != "" {
+		r.kind = ruleTeam
+		r.value = team
+		r.members = members
+	}
+
+	var ruleID int64
+	var found bool
+	if un != "" {
+		if ruleID, found, err = findRule(ctx, r); err != nil {
+			panic(err)
+		} else if found {
+			// also the packages the rule subscribed to, that it doesn't cover anymore
+			aps, err := ruleSubscriptions(ctx, ruleID, false)
+			if err != nil {
+				panic(err)
+			}
+			for _, ap := range aps {
+				if !slices.Contains(mps, ap) {
+					mps = append(mps, ap)
+				}
+			}
+		}
+	}
+
+	if len(mps) == 0 && !found {
+		notFound := fmt.Sprintf("No packages found for maintainer `%s`", handle)
+		if team != "" {
+			notFound = fmt.Sprintf("No packages found for team `%s`", team)
+		}
+		if _, err := h.sender(ctx, notFound, evt.RoomID); err != nil {
 			slog.Error(err.Error())
 		}
 
@@ -207,13 +792,29 @@ func handleFollowUnfollow(ctx context.Context, msg string, evt *event.Event) {
 	}
 
 	if un != "" {
-		handleUnfollow(ctx, mps, evt)
+		if len(mps) > 0 {
+			// deleting the rule first would delete its subscriptions, and they
+			// wouldn't be listed in the reply
+			handleUnfollow(ctx, mps, ruleID, evt)
+		} else if _, err := h.sender(ctx, fmt.Sprintf("Unfollowed %s, which has no packages", r), evt.RoomID); err != nil {
+			slog.Error(err.Error())
+		}
+		if err := deleteRule(ctx, r); err != nil {
+			panic(err)
+		}
 	} else {
-		handleFollow(ctx, mps, evt)
+		id, err := saveRule(ctx, r)
+		if err != nil {
+			panic(err)
+		}
+		handleFollow(ctx, mps, id, evt)
 	}
 }
 
-func handleUnfollow(ctx context.Context, mps []string, evt *event.Event) {
+// Unsubscribes the room from packages, if they were subscribed to manually or
+// by the rule being unfollowed. Other rooms, and other rules of the room, are
+// left alone.
+func handleUnfollow(ctx context.Context, mps []string, ruleID int64, evt *event.Event) {
 	// Create the right number of placeholders: "(?,?,?)"
 	qmarks := make([]string, len(mps))
 	args := make([]any, len(mps))
@@ -223,9 +824,8 @@ func handleUnfollow(ctx context.Context, mps []string, evt *event.Event) {
 	}
 	placeholders := strings.Join(qmarks, ",")
 
-	query := fmt.Sprintf("DELETE FROM subscriptions WHERE mxid = ? AND attr_path IN (%s) RETURNING attr_path", placeholders)
-	// We need to stash evt.Sender in args, because we can onlu pass two arguments to db.Exec
-	args = append([]any{evt.Sender}, args...)
+	query := fmt.Sprintf("DELETE FROM subscriptions WHERE roomid = ? AND (rule_id IS NULL OR rule_id = ?) AND attr_path IN (%s) RETURNING attr_path", placeholders)
+	args = append([]any{evt.RoomID, ruleID}, args...)
 	rows, err := clients.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		panic(err)
@@ -272,13 +872,17 @@ func handleUnfollow(ctx context.Context, mps []string, evt *event.Event) {
 	slog.Info("sent unfollow response", "sender", evt.Sender)
 }
 
+// Subscribes to packages on behalf of a follow rule, which keeps them up to
+// date as maintainers change.
+//
 // TODO: if this is taking long, we could let the user know stuff is happening while they wait.
-func handleFollow(ctx context.Context, mps []string, evt *event.Event) {
+func handleFollow(ctx context.Context, mps []string, ruleID int64, evt *event.Event) {
 	// used for output message
 	var l []string
 
 	var esErr existingSubscriptionError
 	var httpErr *HTTPError
+	var noLogsErr *NoLogsError
 
 	// Start timer to notify user if processing takes too long
 	timer := time.AfterFunc(NOTIFY_THRESHOLD, func() {
@@ -289,14 +893,22 @@ func handleFollow(ctx context.Context, mps []string, evt *event.Event) {
 	})
 
 	for _, ap := range mps {
-		if err := subscribe(ctx, ap, evt); err != nil {
+		if err := addSubscription(ctx, ap, evt.RoomID.String(), evt.Sender.String(), ruleID); err != nil {
 			if errors.As(err, &esErr) {
 				slog.Debug("skipped already existing subscription", "ap", ap)
 
+				continue
+			} else if errors.As(err, &noLogsErr) {
+				slog.Debug("skipped package without logs", "ap", ap)
+
 				continue
 			} else if errors.As(err, &httpErr) {
 				slog.Warn("HTTP error while subscribing to package", "ap", ap, "error", httpErr.StatusCode)
 
+				continue
+			} else if isNetworkError(err) {
+				slog.Warn("network error while subscribing to package", "ap", ap, "error", err)
+
 				continue
 			} else {
 				panic(err)
@@ -309,7 +921,7 @@ func handleFollow(ctx context.Context, mps []string, evt *event.Event) {
 	timer.Stop()
 
 	var msg string
-	msg = fmt.Sprintf("Subscribed to packages:\n %s", strings.Join(l, "\n"))
+	msg = fmt.Sprintf("Subscribed to packages:\n %s\n\nPackages added to or removed from this list later will be subscribed to or unsubscribed from automatically.", strings.Join(l, "\n"))
 
 	if _, err := h.sender(ctx, msg, evt.RoomID); err != nil {
 		slog.Error(err.Error())
@@ -330,6 +942,330 @@ func handleFollow(ctx context.Context, mps []string, evt *event.Event) {
 	slog.Info("sent follow response", "sender", evt.Sender)
 }
 
+// Enables or disables opt-in notices for the room, or lists them if no kind is given.
+func handleNotify(ctx context.Context, msg string, evt *event.Event) {
+	matches := regexes.Notify().FindStringSubmatch(msg)
+	kind := noticeKind(strings.ToLower(matches[1]))
+	onOff := strings.ToLower(matches[2])
+
+	var reply string
+	if kind == "" {
+		enabled, err := listOptIns(ctx, evt.RoomID.String())
+		if err != nil {
+			panic(err)
+		}
+
+		kinds := make([]noticeKind, 0, len(optInNotices))
+		for k := range optInNotices {
+			kinds = append(kinds, k)
+		}
+		slices.Sort(kinds)
+
+		var l []string
+		for _, k := range kinds {
+			state := "off"
+			if slices.Contains(enabled, k) {
+				state = "on"
+			}
+			l = append(l, fmt.Sprintf("- `%s` (%s): when %s", k, state, optInNotices[k]))
+		}
+
+		reply = fmt.Sprintf("Optional notifications:\n%s", strings.Join(l, "\n"))
+	} else if !isOptIn(kind) {
+		reply = fmt.Sprintf("Unknown notification `%s`. Type **notify** for a list.", kind)
+	} else if onOff == "on" {
+		if _, err := clients.db.ExecContext(ctx, "INSERT OR IGNORE INTO opt_ins(roomid, kind) VALUES (?, ?)", evt.RoomID, kind); err != nil {
+			panic(err)
+		}
+		reply = fmt.Sprintf("You will be notified when %s.", optInNotices[kind])
+	} else {
+		if _, err := clients.db.ExecContext(ctx, "DELETE FROM opt_ins WHERE roomid = ? AND kind = ?", evt.RoomID, kind); err != nil {
+			panic(err)
+		}
+		reply = fmt.Sprintf("You will no longer be notified when %s.", optInNotices[kind])
+	}
+
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+
+	slog.Info("received notify", "kind", kind, "value", onOff, "sender", evt.Sender)
+}
+
+// Returns the notices a room has opted in to.
+func listOptIns(ctx context.Context, roomid string) ([]noticeKind, error) {
+	rows, err := clients.db.QueryContext(ctx, "SELECT kind FROM opt_ins WHERE roomid = ? ORDER BY kind", roomid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var kinds []noticeKind
+	for rows.Next() {
+		var k noticeKind
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		kinds = append(kinds, k)
+	}
+
+	return kinds, rows.Err()
+}
+
+// Adds, lists or removes the room's filters.
+func handleFilter(ctx context.Context, msg string, evt *event.Event) {
+	matches := regexes.Filter().FindStringSubmatch(msg)
+
+	var reply string
+	switch {
+	case matches[1] != "":
+		pattern := strings.TrimSpace(matches[2])
+		if pattern == "" {
+			reply = "Filters can't be empty"
+
+			break
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			reply = fmt.Sprintf("Invalid regex `%s`: %s", pattern, err)
+
+			break
+		}
+
+		res, err := clients.db.ExecContext(ctx, "INSERT OR IGNORE INTO filters(roomid, mxid, pattern) VALUES (?, ?, ?)", evt.RoomID, evt.Sender, pattern)
+		if err != nil {
+			panic(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			panic(err)
+		} else if n == 0 {
+			reply = fmt.Sprintf("Filter `%s` already present", pattern)
+		} else {
+			reply = fmt.Sprintf("Failures whose log excerpt matches `%s` will no longer be notified.", pattern)
+		}
+	case matches[3] != "":
+		filters, err := listFilters(ctx, evt.RoomID.String())
+		if err != nil {
+			panic(err)
+		}
+
+		if len(filters) == 0 {
+			reply = "No filters"
+		} else {
+			reply = fmt.Sprintf("Filters:\n%s", strings.Join(filters, "\n"))
+		}
+	default:
+		res, err := clients.db.ExecContext(ctx, "DELETE FROM filters WHERE roomid = ? AND id = ?", evt.RoomID, matches[5])
+		if err != nil {
+			panic(err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			panic(err)
+		} else if n == 0 {
+			reply = fmt.Sprintf("Could not find filter %s", matches[5])
+		} else {
+			reply = fmt.Sprintf("Removed filter %s", matches[5])
+		}
+	}
+
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+
+	slog.Info("received filter", "msg", msg, "sender", evt.Sender)
+}
+
+// Sets up, shows or turns off the room's digest.
+func handleDigest(ctx context.Context, msg string, evt *event.Event) {
+	matches := regexes.Digest().FindStringSubmatch(msg)
+	roomid := evt.RoomID.String()
+
+	var reply string
+	switch {
+	case matches[1] != "" || matches[3] != "":
+		d := digest{roomid: roomid, period: "daily", at: matches[2]}
+		if matches[3] != "" {
+			d.period = "weekly"
+			d.at = matches[5]
+			d.weekday = weekdays[strings.ToLower(matches[4])]
+		}
+		if d.at == "" {
+			d.at = "09:00"
+		}
+		if _, err := time.Parse("15:04", d.at); err != nil {
+			reply = fmt.Sprintf("Invalid time `%s`, expected e.g. 09:00", d.at)
+
+			break
+		}
+
+		if err := saveDigest(ctx, d); err != nil {
+			panic(err)
+		}
+		reply = fmt.Sprintf("Failures will be sent in a digest, %s. The next one is due on %s.", d, d.next(time.Now()).Format("2006-01-02 15:04 UTC"))
+	case matches[6] != "":
+		if _, ok, err := getDigest(ctx, roomid); err != nil {
+			panic(err)
+		} else if !ok {
+			reply = "Digest already off"
+
+			break
+		}
+
+		// don't lose the failures queued so far
+		if sent, err := deliverDigest(ctx, roomid, "Failures since your last digest"); err != nil {
+			panic(err)
+		} else if !sent {
+			reply = "Could not send the failures queued for your digest, so it stays on. Please try again later."
+
+			break
+		}
+		if _, err := clients.db.ExecContext(ctx, "DELETE FROM digests WHERE roomid = ?", roomid); err != nil {
+			panic(err)
+		}
+		reply = "Digest off, failures will be sent as they happen."
+	default:
+		d, ok, err := getDigest(ctx, roomid)
+		if err != nil {
+			panic(err)
+		}
+		if ok {
+			reply = fmt.Sprintf("Failures are sent in a digest, %s.", d)
+		} else {
+			reply = "Failures are sent as they happen. Type **digest daily 09:00** or **digest weekly mon** to receive them in a digest."
+		}
+	}
+
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+
+	slog.Info("received digest", "msg", msg, "sender", evt.Sender)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Returns the room's filters, formatted as a list.
+func listFilters(ctx context.Context, roomid string) ([]string, error) {
+	rows, err := clients.db.QueryContext(ctx, "SELECT id, pattern FROM filters WHERE roomid = ? ORDER BY id", roomid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filters []string
+	for rows.Next() {
+		var id int64
+		var pattern string
+		if err := rows.Scan(&id, &pattern); err != nil {
+			return nil, err
+		}
+		filters = append(filters, fmt.Sprintf("- %d: `%s`", id, pattern))
+	}
+
+	return filters, rows.Err()
+}
+
+// Labels stored in the feedback table.
+const (
+	labelFalsePositive = "false-positive"
+	labelFalseNegative = "false-negative"
+)
+
+// Records a user's report that a log was misclassified.
+func handleFeedback(ctx context.Context, msg string, evt *event.Event) {
+	matches := regexes.Feedback().FindStringSubmatch(msg)
+	cmd := strings.ToLower(matches[1])
+	ap := matches[2]
+	date := matches[3]
+
+	label, wantStatus := labelFalsePositive, logStatusError
+	if cmd == "missederror" {
+		label, wantStatus = labelFalseNegative, logStatusOK
+	}
+
+	slog.Info("received feedback", "label", label, "attr_path", ap, "date", date, "sender", evt.Sender)
+
+	// without a date, the latest checked log
+	var logID int64
+	var status string
+	err := clients.db.QueryRowContext(ctx, `
+    SELECT id, date, status FROM logs
+    WHERE attr_path = ? AND (? = '' OR date = ?)
+    ORDER BY date DESC LIMIT 1`, ap, date, date).Scan(&logID, &date, &status)
+
+	var reply string
+	if errors.Is(err, sql.ErrNoRows) {
+		reply = fmt.Sprintf("No log checked by the bot found for `%s`. Only logs of packages someone is subscribed to are checked.", ap)
+	} else if err != nil {
+		panic(err)
+	} else if status != wantStatus {
+		if status == logStatusError {
+			reply = fmt.Sprintf("The %s log of `%s` was already reported as a failure.", date, ap)
+		} else {
+			reply = fmt.Sprintf("The %s log of `%s` was not reported as a failure.", date, ap)
+		}
+	} else {
+		if _, err := clients.db.ExecContext(ctx, "INSERT OR IGNORE INTO feedback(log_id, roomid, mxid, label) VALUES (?, ?, ?, ?)", logID, evt.RoomID, evt.Sender, label); err != nil {
+			panic(err)
+		}
+		reply = fmt.Sprintf("Thanks! Recorded the %s log of `%s` as a %s.", date, ap, label)
+	}
+
+	if _, err := h.sender(ctx, reply, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// Number of logs listed by the report command.
+const reportSize = 20
+
+// Lists the logs with the most feedback, for admins.
+func handleReport(ctx context.Context, evt *event.Event) {
+	rows, err := clients.db.QueryContext(ctx, `
+    SELECT l.attr_path, l.date, l.url, COALESCE(l.rule, ''), f.label, COUNT(*) AS reports
+    FROM feedback f JOIN logs l ON l.id = f.log_id
+    GROUP BY f.log_id, f.label
+    ORDER BY reports DESC, l.date DESC
+    LIMIT ?`, reportSize)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	var l []string
+	for rows.Next() {
+		var ap, date, url, rule, label string
+		var reports int
+		if err := rows.Scan(&ap, &date, &url, &rule, &label, &reports); err != nil {
+			panic(err)
+		}
+
+		if rule == "" {
+			rule = "none"
+		}
+		l = append(l, fmt.Sprintf("- `%s` [%s](%s): %d × %s, rule `%s`", ap, date, url, reports, label, rule))
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	msg := "No feedback yet"
+	if len(l) > 0 {
+		msg = fmt.Sprintf("Most reported logs:\n\n%s", strings.Join(l, "\n"))
+	}
+
+	if _, err := h.sender(ctx, msg, evt.RoomID); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
 // Checks, via an SQL query, if the user is already subscribed to the package
 func checkIfSubExists(ctx context.Context, attr_path, roomid string) (exists bool, err error) {
 	err = clients.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM subscriptions WHERE roomid = ? AND attr_path = ? LIMIT 1)", roomid, attr_path).Scan(&exists)
@@ -345,7 +1281,53 @@ func findPackagesForHandle(ctx context.Context, handle string) ([]string, error)
 	// The query needs to handle:
 	// missing maintainers
 	// missing github field
-	query, err := gojq.Parse(fmt.Sprintf(`.packages|to_entries[]|select(.value.meta.maintainers[]?|.github // "" |test("^%s$"; "i"))|.key`, handle))
+	mps, err := queryJSONBlob(ctx, fmt.Sprintf(`.packages|to_entries[]|select(.value.meta.maintainers[]?|.github // "" |test("^%s$"; "i"))|.key`, handle))
+	if err != nil {
+		return nil, err
+	}
+
+	return trackedPackages(ctx, mps)
+}
+
+// Like findPackagesForHandle, but for packages owned by a nixpkgs team, given
+// its GitHub team or short name. If members is true, it also includes packages
+// maintained by the team's members.
+func findPackagesForTeam(ctx context.Context, team string, members bool) ([]string, error) {
+	// a team matches by its GitHub team (e.g. nix-team), or its short name
+	// (e.g. "Nix team"), with or without the "team" suffix
+	name := fmt.Sprintf("^%s(?:[- ]team)?$", strings.ReplaceAll(team, "-", "[- ]"))
+	match := fmt.Sprintf(`(.shortName // "" |test("%[1]s"; "i")) or any(.githubTeams[]?; test("%[1]s"; "i"))`, name)
+
+	mps, err := queryJSONBlob(ctx, fmt.Sprintf(`.packages|to_entries[]|select(any(.value.meta.teams[]?; %s))|.key`, match))
+	if err != nil {
+		return nil, err
+	}
+
+	if members {
+		handles, err := queryJSONBlob(ctx, fmt.Sprintf(`[.packages[].meta.teams[]?|select(%s)|.members[]?.github // empty]|unique[]`, match))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(handles) > 0 {
+			for i, handle := range handles {
+				handles[i] = regexp.QuoteMeta(handle)
+			}
+
+			hps, err := queryJSONBlob(ctx, fmt.Sprintf(`.packages|to_entries[]|select(any(.value.meta.maintainers[]?; .github // "" |test("^(?:%s)$"; "i")))|.key`, strings.Join(handles, "|")))
+			if err != nil {
+				return nil, err
+			}
+			mps = append(mps, hps...)
+		}
+	}
+
+	return trackedPackages(ctx, mps)
+}
+
+// Runs a gojq query returning strings against the JSON blob.
+func queryJSONBlob(ctx context.Context, q string) ([]string, error) {
+	query, err := gojq.Parse(q)
 	if err != nil {
 		slog.Error("gojq parse", "error", err)
 
@@ -354,11 +1336,10 @@ func findPackagesForHandle(ctx context.Context, handle string) ([]string, error)
 
 	slog.Debug("gojq query", "query", query)
 
-	// list of maintained packages
 	// jsblob is populated and updated out-of-band.
 	mu.Lock()
 	defer mu.Unlock()
-	var mps []string
+	var res []string
 	iter := query.RunWithContext(ctx, jsblob)
 
 	for {
@@ -374,15 +1355,21 @@ func findPackagesForHandle(ctx context.Context, handle string) ([]string, error)
 
 			return nil, err
 		}
-		mps = append(mps, regexes.NormalizeAttrPath(v.(string)))
+		res = append(res, v.(string))
 	}
 
+	return res, nil
+}
+
+// Normalizes attr paths from the JSON blob, and returns those in the packages
+// table, sorted.
+func trackedPackages(ctx context.Context, mps []string) ([]string, error) {
 	// Create the right number of placeholders: "(?,?,?)"
 	qmarks := make([]string, len(mps))
 	args := make([]any, len(mps))
 	for i, v := range mps {
 		qmarks[i] = "?"
-		args[i] = v
+		args[i] = regexes.NormalizeAttrPath(v)
 	}
 	placeholders := strings.Join(qmarks, ",")
 
@@ -407,7 +1394,8 @@ func findPackagesForHandle(ctx context.Context, handle string) ([]string, error)
 	return aps, nil
 }
 
-// subscribe fetches a last_visited date, adds it to the packages table, and adds an entry into the subscriptions table.
+// addSubscription fetches a last_visited date, adds it to the packages table, and adds an entry into the subscriptions table.
+// If ruleID isn't 0, the subscription belongs to that rule.
 //
 // If the subscription already exists, it returns an existingSubscriptionError.
 //
@@ -425,10 +1413,10 @@ func findPackagesForHandle(ctx context.Context, handle string) ([]string, error)
 // - but the log predates the subscription, so we notified on a stale log
 //
 // NOTE: this invariant is also enforced via an SQL trigger.
-func subscribe(ctx context.Context, ap string, evt *event.Event) error {
-	slog.Debug("subscribing", "attr_path", ap)
+func addSubscription(ctx context.Context, ap, roomid, mxid string, ruleID int64) error {
+	slog.Debug("subscribing", "attr_path", ap, "rule", ruleID)
 
-	if exists, err := checkIfSubExists(ctx, ap, evt.RoomID.String()); err != nil {
+	if exists, err := checkIfSubExists(ctx, ap, roomid); err != nil {
 		return err
 	} else if exists {
 		return existingSubscriptionError(ap)
@@ -447,7 +1435,7 @@ func subscribe(ctx context.Context, ap string, evt *event.Event) error {
 		return err
 	}
 
-	if _, err := clients.db.ExecContext(ctx, "INSERT INTO subscriptions(attr_path, roomid, mxid) VALUES (?, ?, ?)", ap, evt.RoomID, evt.Sender); err != nil {
+	if _, err := clients.db.ExecContext(ctx, "INSERT INTO subscriptions(attr_path, roomid, mxid, rule_id) VALUES (?, ?, ?, NULLIF(?, 0))", ap, roomid, mxid, ruleID); err != nil {
 		return err
 	}
 
@@ -7,8 +7,11 @@ import (
 	"log/slog"
 	"os"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/asymmetric/nixpkgs-update-notifier/classifier"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -20,6 +23,14 @@ var testSender = func(ctx context.Context, text string, _ id.RoomID) (*mautrix.R
 	return nil, nil
 }
 
+// Returns a sender that appends the messages it sends to sent.
+func captureSender(sent *[]string) func(context.Context, string, id.RoomID) (*mautrix.RespSendEvent, error) {
+	return func(ctx context.Context, text string, _ id.RoomID) (*mautrix.RespSendEvent, error) {
+		*sent = append(*sent, text)
+		return nil, nil
+	}
+}
+
 func init() {
 	slog.SetLogLoggerLevel(slog.LevelError)
 	ctx = context.Background()
@@ -144,6 +155,34 @@ func TestSubDuplicates(t *testing.T) {
 }
 
 // TODO: test non-existent package
+func TestSubWithoutLogs(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			if url == packageURL("bar") {
+				return "", &NoLogsError{URL: url}
+			}
+			return "2024-12-10", nil
+		},
+		sender: captureSender(&sent),
+	}
+	addPackages("foo", "bar")
+
+	message("sub foo bar")
+
+	expected := []string{"Subscribed to package `foo`\n\nCould not subscribe to packages without any logs yet:\n - `bar`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+	if exists, _ := checkIfSubExists(ctx, "bar", evt.RoomID.String()); exists {
+		t.Error("should not be subscribed to a package without logs")
+	}
+}
+
 func TestUnsub(t *testing.T) {
 	if err := setupDB(ctx, ":memory:"); err != nil {
 		panic(err)
@@ -296,6 +335,50 @@ func TestSubUnsub(t *testing.T) {
 	}
 }
 
+func TestSubMultiple(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "1999", nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	addPackages("foo", "bar", "python3Packages.baz", "python311Packages.baz")
+	sub("foo")
+
+	sent = nil
+	message("sub foo, bar *.baz nope")
+
+	expected := []string{"Subscribed to packages:\n - `bar`\n- `python311Packages.baz`\n- `python3Packages.baz`" +
+		"\n\nSubscription already present: foo" +
+		"\n\nNo matches for `nope`. The list of packages is [here](https://nixpkgs-update-logs.nix-community.org/)"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	sent = nil
+	message("unsub foo,*.baz nope")
+
+	expected = []string{"Unsubscribed from packages:\n - `foo`\n- `python311Packages.baz`\n- `python3Packages.baz`" +
+		"\n\nCould not find subscriptions for pattern `nope`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	var count int
+	if err := clients.db.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+		panic(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 subscription left, got %d", count)
+	}
+}
+
 func TestOverlapping(t *testing.T) {
 	if err := setupDB(ctx, ":memory:"); err != nil {
 		panic(err)
@@ -546,7 +629,13 @@ func TestUnfollow(t *testing.T) {
 	fol("asymmetric")
 
 	// Then unfollow
+	var sent []string
+	h.sender = captureSender(&sent)
 	unfol("asymmetric")
+	expected := []string{"Unsubscribed from packages:\n " + strings.Join(formatPackageList([]string{"btrbk", "btrfs-list", "diceware", "python3Packages.diceware"}), "\n")}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
 
 	for _, p := range mps {
 		if exists, _ := checkIfSubExists(ctx, p, evt.RoomID.String()); exists {
@@ -557,6 +646,86 @@ func TestUnfollow(t *testing.T) {
 	if exists, _ := checkIfSubExists(ctx, "foo", evt.RoomID.String()); !exists {
 		t.Errorf("should be subscribed to %s", "foo")
 	}
+
+	t.Run("rule without packages", func(t *testing.T) {
+		// e.g. the maintainer dropped all their packages
+		if _, err := saveRule(ctx, rule{roomid: evt.RoomID.String(), mxid: evt.Sender.String(), kind: ruleMaintainer, value: "nobody"}); err != nil {
+			panic(err)
+		}
+
+		sent = nil
+		unfol("nobody")
+		if expected := []string{"Unfollowed maintainer `nobody`, which has no packages"}; !slices.Equal(expected, sent) {
+			t.Errorf("expected: %q\ngot: %q", expected, sent)
+		}
+
+		if rules, err := listRules(ctx, evt.RoomID.String(), ruleMaintainer); err != nil {
+			panic(err)
+		} else if len(rules) != 0 {
+			t.Errorf("expected the rule to be deleted, got: %v", rules)
+		}
+	})
+
+	t.Run("other rooms", func(t *testing.T) {
+		follow := func(roomid string) {
+			defer func(r id.RoomID) { evt.RoomID = r }(evt.RoomID)
+			evt.RoomID = id.RoomID(roomid)
+			fol("asymmetric")
+		}
+		follow("test-room")
+		follow("other-room")
+
+		unfol("asymmetric")
+
+		for _, p := range mps {
+			if exists, _ := checkIfSubExists(ctx, p, "other-room"); !exists {
+				t.Errorf("other room should still be subscribed to %s", p)
+			}
+		}
+
+		sent = nil
+		reconcileRules(ctx, ruleMaintainer)
+		if len(sent) != 0 {
+			t.Errorf("expected no changes, got: %q", sent)
+		}
+	})
+}
+
+func TestFindPackagesForTeam(t *testing.T) {
+	stubJSONBlob()
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	team := []string{"nix", "nixStatic", "nixVersions.latest"}
+	members := []string{"nix-serve", "valgrind"}
+	addPackages(append(append([]string{"btrbk"}, team...), members...)...)
+
+	for _, name := range []string{"nix", "nix-team", "Nix-Team"} {
+		got, err := findPackagesForTeam(ctx, name, false)
+		if err != nil {
+			panic(err)
+		}
+		if !slices.Equal(team, got) {
+			t.Errorf("%s: expected: %v\ngot: %v", name, team, got)
+		}
+	}
+
+	got, err := findPackagesForTeam(ctx, "nix", true)
+	if err != nil {
+		panic(err)
+	}
+	expected := append(slices.Clone(team), members...)
+	slices.Sort(expected)
+	if !slices.Equal(expected, got) {
+		t.Errorf("expected: %v\ngot: %v", expected, got)
+	}
+
+	if got, err := findPackagesForTeam(ctx, "python", true); err != nil {
+		panic(err)
+	} else if len(got) != 0 {
+		t.Errorf("expected no packages, got: %v", got)
+	}
 }
 
 func TestFindPackagesForHandle(t *testing.T) {
@@ -654,6 +823,383 @@ func TestFindPackagesForHandle(t *testing.T) {
 	})
 }
 
+func TestNotify(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	h = handlers{sender: testSender}
+
+	notify("fixed on")
+
+	kinds, err := listOptIns(ctx, evt.RoomID.String())
+	if err != nil {
+		panic(err)
+	}
+	if expected := []noticeKind{noticeFixed}; !slices.Equal(expected, kinds) {
+		t.Errorf("expected: %v\ngot: %v", expected, kinds)
+	}
+
+	notify("fixed off")
+
+	if kinds, err = listOptIns(ctx, evt.RoomID.String()); err != nil {
+		panic(err)
+	}
+	if len(kinds) != 0 {
+		t.Errorf("expected no opt-ins, got: %v", kinds)
+	}
+
+	notify("bogus on")
+
+	if kinds, err = listOptIns(ctx, evt.RoomID.String()); err != nil {
+		panic(err)
+	}
+	if len(kinds) != 0 {
+		t.Errorf("expected no opt-ins, got: %v", kinds)
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		sender: captureSender(&sent),
+	}
+
+	addPackages("foo")
+	for date, status := range map[string]string{"2024-12-09": logStatusError, "2024-12-10": logStatusOK} {
+		if _, err := clients.db.Exec("INSERT INTO logs(attr_path, date, url, status, rule) VALUES (?, ?, ?, ?, ?)", "foo", date, logURL("foo", date), status, "nix-error"); err != nil {
+			panic(err)
+		}
+	}
+
+	countFeedback := func(label string) (count int) {
+		if err := clients.db.QueryRow("SELECT COUNT(*) FROM feedback WHERE label = ?", label).Scan(&count); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// the latest log isn't an error
+	message("notanerror foo")
+	if count := countFeedback(labelFalsePositive); count != 0 {
+		t.Errorf("expected no feedback, got %d", count)
+	}
+
+	message("notanerror foo 2024-12-09")
+	message("notanerror foo 2024-12-09")
+	if count := countFeedback(labelFalsePositive); count != 1 {
+		t.Errorf("expected 1 false positive, got %d", count)
+	}
+
+	message("missederror foo")
+	if count := countFeedback(labelFalseNegative); count != 1 {
+		t.Errorf("expected 1 false negative, got %d", count)
+	}
+
+	t.Run("report", func(t *testing.T) {
+		defer func(a string) { *admins = a }(*admins)
+
+		// non-admins get the help text
+		sent = nil
+		message("report")
+		if len(sent) != 1 || sent[0] != helpText {
+			t.Errorf("expected help text, got: %v", sent)
+		}
+
+		*admins = fmt.Sprintf("@someone:example.org, %s", evt.Sender)
+		sent = nil
+		message("report")
+		if len(sent) != 1 || !strings.Contains(sent[0], "2024-12-09") || !strings.Contains(sent[0], "rule `nix-error`") {
+			t.Errorf("unexpected report: %v", sent)
+		}
+	})
+}
+
+func TestFilter(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		sender: captureSender(&sent),
+	}
+
+	message("filter add ExitFailure [0-9]+")
+	message("filter add ExitFailure [0-9]+")
+	message("filter add (unclosed")
+
+	sent = nil
+	message("filter list")
+	if expected := []string{"Filters:\n- 1: `ExitFailure [0-9]+`"}; !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	failure := logEntry{Excerpt: "Received ExitFailure 1 when running"}
+	if !isFiltered(ctx, evt.RoomID.String(), failure) {
+		t.Error("expected failure to be filtered")
+	}
+	if isFiltered(ctx, "other-room", failure) {
+		t.Error("filters should only apply to their room")
+	}
+	if isFiltered(ctx, evt.RoomID.String(), logEntry{Excerpt: "error: builder failed"}) {
+		t.Error("expected failure not to be filtered")
+	}
+
+	message("filter rm 2")
+	message("filter rm 1")
+
+	sent = nil
+	message("filter list")
+	if expected := []string{"No filters"}; !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	stubJSONBlob()
+
+	var sent []string
+	var fetched []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			if url == packageURL("nix") {
+				return "", &NoLogsError{URL: url}
+			}
+			return "2024-12-11", nil
+		},
+		logFetcher: func(ctx context.Context, url, since string) (logState, error) {
+			fetched = append(fetched, url)
+			if since != "2024-12-10" {
+				t.Errorf("expected only the latest log to be fetched, got since: %s", since)
+			}
+			return logState{Logs: []logEntry{{Date: "2024-12-11", Category: classifier.HashMismatch}}}, nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	addPackages("btrbk", "python3Packages.diceware", "nix")
+	for _, ap := range []string{"btrbk", "python3Packages.diceware"} {
+		if _, err := clients.db.Exec("INSERT INTO logs(attr_path, date, url, status, category) VALUES (?, ?, ?, ?, ?)", ap, "2024-12-10", logURL(ap, "2024-12-10"), logStatusError, classifier.BuildError); err != nil {
+			panic(err)
+		}
+	}
+	sub("btrbk")
+
+	sent = nil
+	message("status btrbk")
+	expected := []string{strings.Join([]string{
+		"| Package | Latest log | Verdict | Maintainers | Subscribed |",
+		"| --- | --- | --- | --- | --- |",
+		"| `btrbk` | [2024-12-10](https://nixpkgs-update-logs.nix-community.org/btrbk/2024-12-10.log) | error (build error) | asymmetric | yes |",
+	}, "\n")}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+	if len(fetched) != 0 {
+		t.Errorf("expected the stored log to be used, fetched: %v", fetched)
+	}
+
+	t.Run("unsubscribed", func(t *testing.T) {
+		// the stored log is outdated, since nobody is subscribed to the package
+		sent = nil
+		message("status *diceware")
+		if len(sent) != 1 || !strings.Contains(sent[0], "| `python3Packages.diceware` | [2024-12-11](https://nixpkgs-update-logs.nix-community.org/python3Packages.diceware/2024-12-11.log) | error (hash mismatch) | asymmetric | no |") {
+			t.Errorf("unexpected status: %q", sent)
+		}
+
+		sent = nil
+		message("status nix")
+		if len(sent) != 1 || !strings.Contains(sent[0], "| `nix` | no logs yet | - |") {
+			t.Errorf("unexpected status: %q", sent)
+		}
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		defer func(n int) { statusLimit = n }(statusLimit)
+		statusLimit = 1
+
+		sent = nil
+		message("status *")
+		if len(sent) != 1 || !strings.Contains(sent[0], "...and 2 more packages") {
+			t.Errorf("unexpected status: %q", sent)
+		}
+	})
+}
+
+func TestSearchPackages(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	addPackages("acme", "python3Packages.acme", "python3Packages.acme-tiny", "haskellPackages.Acme", "foo")
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"acme", []string{"acme", "haskellPackages.Acme", "python3Packages.acme", "python3Packages.acme-tiny"}},
+		{"*.acme", []string{"python3Packages.acme"}},
+		{"/^python3.*acme/", []string{"python3Packages.acme", "python3Packages.acme-tiny"}},
+		{"bar", nil},
+	}
+	for _, tt := range tests {
+		got, err := searchPackages(ctx, tt.query)
+		if err != nil {
+			panic(err)
+		}
+		if !slices.Equal(tt.expected, got) {
+			t.Errorf("%s: expected: %v\ngot: %v", tt.query, tt.expected, got)
+		}
+	}
+
+	if _, err := searchPackages(ctx, "/(/"); err == nil {
+		t.Error("expected an error for an invalid regex")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		sender: captureSender(&sent),
+	}
+
+	for i := range searchPageSize + 5 {
+		addPackages(fmt.Sprintf("pkg%02d", i))
+	}
+
+	message("search pkg")
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "25 packages match `pkg` (page 1 of 2):") || !strings.HasSuffix(sent[0], "Type **search pkg 2** for more.") {
+		t.Errorf("unexpected results: %q", sent)
+	}
+
+	sent = nil
+	message("search pkg 2")
+	expected := []string{"25 packages match `pkg` (page 2 of 2):\n\n- `pkg20`\n- `pkg21`\n- `pkg22`\n- `pkg23`\n- `pkg24`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	// searching doesn't subscribe
+	var count int
+	if err := clients.db.QueryRow("SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+		panic(err)
+	}
+	if count != 0 {
+		t.Errorf("expected no subscriptions, got %d", count)
+	}
+}
+
+func TestMute(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "2000-01-01", nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	addPackages("foo", "bar")
+	sub("foo")
+	sub("bar")
+
+	sent = nil
+	message("mute foo")
+	message("mute baz until-fixed")
+	expected := []string{
+		"Usage: **mute foo 7d**, **mute foo until-fixed** or **unmute foo**",
+		"Could not find subscriptions for pattern `baz`",
+	}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	message("mute foo until-fixed")
+	message("mute bar 2d")
+
+	sent = nil
+	message("subs")
+	until := time.Now().UTC().Add(48 * time.Hour).Format("2006-01-02 15:04")
+	expected = []string{fmt.Sprintf("Your subscriptions:\n\n- `bar` (muted until %s UTC)\n- `foo` (muted until it builds again)", until)}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	newLog := func(ap string, l logEntry) {
+		var out outbox
+		handleLogResult(ctx, logResult{attrPath: ap, state: logState{Logs: []logEntry{l}}}, &out)
+		out.flush(ctx)
+	}
+
+	sent = nil
+	newLog("foo", logEntry{Date: "2000-01-02", Category: classifier.BuildError})
+	newLog("bar", logEntry{Date: "2000-01-02", Category: classifier.BuildError})
+	if len(sent) != 0 {
+		t.Errorf("expected no notices, got: %q", sent)
+	}
+
+	// the first clean log unmutes
+	newLog("foo", logEntry{Date: "2000-01-03", Category: classifier.Success})
+	newLog("foo", logEntry{Date: "2000-01-04", Category: classifier.BuildError})
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "New build error for package `foo`") {
+		t.Errorf("expected a notice for foo, got: %q", sent)
+	}
+
+	// expired mutes are cleared
+	if _, err := clients.db.Exec("UPDATE subscriptions SET muted_until = datetime('now', '-1 minute') WHERE attr_path = 'bar'"); err != nil {
+		panic(err)
+	}
+	h.logFetcher = func(ctx context.Context, url, since string) (logState, error) {
+		return logState{}, nil
+	}
+	updateSubs(ctx)
+
+	sent = nil
+	message("subs")
+	expected = []string{"Your subscriptions:\n\n- `bar`\n- `foo`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	message("mute * 1w")
+	sent = nil
+	message("unmute *")
+	expected = []string{"Unmuted packages:\n- `bar`\n- `foo`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	t.Run("too long", func(t *testing.T) {
+		for _, d := range []string{"53w", "9999999999999w", "99999999999999999999h"} {
+			sent = nil
+			message("mute foo " + d)
+			expected := []string{"Packages can be muted for at most a year, or **until-fixed**"}
+			if !slices.Equal(expected, sent) {
+				t.Errorf("%s: expected: %q\ngot: %q", d, expected, sent)
+			}
+		}
+
+		sent = nil
+		message("mute foo 52w")
+		if len(sent) != 1 || !strings.HasPrefix(sent[0], "Muted packages until") {
+			t.Errorf("expected foo to be muted, got: %q", sent)
+		}
+	})
+}
+
 func fillEventContent(evt *event.Event, body string) {
 	evt.Content = event.Content{
 		Parsed: &event.MessageEventContent{
@@ -692,6 +1238,16 @@ func unfol(handle string) {
 	handleMessage(ctx, evt)
 }
 
+func message(body string) {
+	fillEventContent(evt, body)
+	handleMessage(ctx, evt)
+}
+
+func notify(args string) {
+	fillEventContent(evt, fmt.Sprintf("notify %s", args))
+	handleMessage(ctx, evt)
+}
+
 func stubJSONBlob() {
 	data, err := os.ReadFile("testdata/packages.json")
 	if err != nil {
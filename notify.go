@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var notifyRemind = flag.Duration("notify.remind", 0, "How often to remind subscribers of a package that keeps failing with the same error (0 to never remind)")
+
+// noticeKind is the kind of event subscribers are notified about.
+type noticeKind string
+
+const (
+	// A new log contains an error.
+	noticeFailure noticeKind = "failure"
+	// A new log contains the same error as the previous ones, and the last
+	// notice about it was sent more than -notify.remind ago.
+	noticeReminder noticeKind = "reminder"
+	// A new log is clean, while the previous one contained an error.
+	noticeFixed noticeKind = "fixed"
+	// nixpkgs-update opened a pull request.
+	noticePR noticeKind = "pr"
+)
+
+// Notices that rooms only receive after opting in with "notify <kind> on",
+// with their description.
+var optInNotices = map[noticeKind]string{
+	noticeFixed: "a failing package builds again",
+	noticePR:    "r-ryantm opens a pull request for a package",
+}
+
+// Sends a notice about a package's log to all rooms subscribed to it.
+//
+// Opt-in notices are only sent to rooms that enabled them.
+func notifySubscribers(ctx context.Context, kind noticeKind, attr_path string, l logEntry) {
+	// - find all subscribers for package
+	// - send message in respective room
+	// - if we're not in that room, drop from db of subs?
+	s := noticeText(kind, attr_path, l)
+	for _, roomID := range subscriberRooms(ctx, kind, attr_path) {
+		if isFiltered(ctx, roomID, l) {
+			continue
+		}
+
+		slog.Info("notifying subscriber", "roomid", roomID, "kind", kind)
+		send(ctx, s, roomID)
+	}
+}
+
+// Returns the rooms that should receive a notice about a package.
+func subscriberRooms(ctx context.Context, kind noticeKind, attr_path string) []string {
+	rows, err := clients.db.QueryContext(ctx, `
+    SELECT DISTINCT s.roomid
+    FROM subscriptions s
+    WHERE s.attr_path = ?
+      AND NOT s.muted_until_fixed
+      AND (s.muted_until IS NULL OR s.muted_until <= datetime('now'))
+      AND (? OR EXISTS (SELECT 1 FROM opt_ins o WHERE o.roomid = s.roomid AND o.kind = ?))`, attr_path, !isOptIn(kind), kind)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	roomIDs := make([]string, 0)
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			panic(err)
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return roomIDs
+}
+
+func noticeText(kind noticeKind, attr_path string, l logEntry) string {
+	logPath := logURL(attr_path, l.Date)
+
+	var s string
+	switch kind {
+	case noticeFixed:
+		s = fmt.Sprintf("Package `%s` builds again: %s", attr_path, logPath)
+	case noticeReminder:
+		s = fmt.Sprintf("Package `%s` still fails with the same %s: %s", attr_path, l.Category.Description(), logPath)
+	case noticePR:
+		s = fmt.Sprintf("Pull request opened for package `%s`", attr_path)
+		if l.OldVersion != "" {
+			s += fmt.Sprintf(" (%s → %s)", l.OldVersion, l.NewVersion)
+		}
+		s += fmt.Sprintf(": %s\n\nLog: %s", l.PRURL, logPath)
+	default:
+		s = fmt.Sprintf("New %s for package `%s`: %s", l.Category.Description(), attr_path, logPath)
+		if l.Excerpt != "" {
+			s += "\n\n" + codeBlock(l.Excerpt)
+		}
+	}
+
+	return s
+}
+
+func send(ctx context.Context, text, roomID string) {
+	if _, err := h.sender(ctx, text, id.RoomID(roomID)); err != nil {
+		// TODO check if we're not in room, in that case remove sub
+		slog.Error(err.Error())
+	}
+}
+
+// outbox collects the failure notices of an update run, so that packages
+// failing with the same error, e.g. because a shared dependency broke, can be
+// reported in a single message per room.
+type outbox struct {
+	// rooms in the order they were first added to
+	rooms    []string
+	failures map[string][]failure
+}
+
+type failure struct {
+	kind     noticeKind
+	attrPath string
+	log      logEntry
+}
+
+// Queues a failure notice (or reminder) for the rooms subscribed to a package.
+// Rooms receiving digests get it in their next digest instead.
+func (o *outbox) add(ctx context.Context, kind noticeKind, attr_path string, l logEntry) {
+	if o.failures == nil {
+		o.failures = make(map[string][]failure)
+	}
+
+	for _, roomID := range subscriberRooms(ctx, kind, attr_path) {
+		if isFiltered(ctx, roomID, l) {
+			continue
+		}
+
+		if _, ok, err := getDigest(ctx, roomID); err != nil {
+			fatal(err)
+		} else if ok {
+			if err := queueDigest(ctx, roomID, failure{kind, attr_path, l}); err != nil {
+				fatal(err)
+			}
+
+			continue
+		}
+
+		if _, ok := o.failures[roomID]; !ok {
+			o.rooms = append(o.rooms, roomID)
+		}
+		o.failures[roomID] = append(o.failures[roomID], failure{kind, attr_path, l})
+	}
+}
+
+// Sends the queued notices, grouping failures with the same fingerprint, and
+// empties the outbox.
+func (o *outbox) flush(ctx context.Context) {
+	for _, roomID := range o.rooms {
+		for _, group := range groupFailures(o.failures[roomID]) {
+			var s string
+			if len(group) == 1 {
+				f := group[0]
+				s = noticeText(f.kind, f.attrPath, f.log)
+			} else {
+				s = clusterText(group)
+			}
+
+			slog.Info("notifying subscriber", "roomid", roomID, "kind", group[0].kind, "packages", len(group))
+			send(ctx, s, roomID)
+		}
+	}
+
+	*o = outbox{}
+}
+
+// Groups failures of different packages by kind and fingerprint, in order of
+// first occurrence. Failures without a fingerprint are never grouped.
+func groupFailures(failures []failure) [][]failure {
+	var groups [][]failure
+	type key struct {
+		kind        noticeKind
+		fingerprint string
+	}
+	idxs := make(map[key]int)
+
+	for _, f := range failures {
+		k := key{f.kind, f.log.Fingerprint}
+		i, ok := idxs[k]
+		// several logs of the same package are notified separately
+		if f.log.Fingerprint == "" || (ok && slices.ContainsFunc(groups[i], func(g failure) bool { return g.attrPath == f.attrPath })) {
+			groups = append(groups, []failure{f})
+		} else if ok {
+			groups[i] = append(groups[i], f)
+		} else {
+			idxs[k] = len(groups)
+			groups = append(groups, []failure{f})
+		}
+	}
+
+	return groups
+}
+
+// Describes several packages failing with the same error.
+func clusterText(group []failure) string {
+	var sb strings.Builder
+
+	first := group[0].log
+	verb := "failing"
+	if group[0].kind == noticeReminder {
+		verb = "still failing"
+	}
+	fmt.Fprintf(&sb, "%d packages %s with the same %s", len(group), verb, first.Category.Description())
+	if len(first.Matches) > 0 {
+		fmt.Fprintf(&sb, ":\n\n%s", codeBlock(truncate(first.Matches[0], maxExcerptLineLength)))
+	}
+	sb.WriteString("\n")
+
+	for _, f := range group {
+		fmt.Fprintf(&sb, "\n- `%s`: %s", f.attrPath, logURL(f.attrPath, f.log.Date))
+	}
+
+	return sb.String()
+}
+
+// Returns whether a package failing with the same error as in its previous log
+// is due for a reminder, given the date of the new log.
+//
+// It returns "" if subscribers shouldn't be notified.
+func failureReminder(ctx context.Context, attr_path, date string) noticeKind {
+	if *notifyRemind <= 0 {
+		slog.Debug("same failure as before, not notifying", "attr_path", attr_path)
+
+		return ""
+	}
+
+	var last sql.NullString
+	if err := clients.db.QueryRowContext(ctx, "SELECT MAX(date) FROM logs WHERE attr_path = ? AND notified", attr_path).Scan(&last); err != nil {
+		fatal(err)
+	}
+	if !last.Valid {
+		return noticeReminder
+	}
+
+	lt, err := time.Parse(time.DateOnly, last.String)
+	if err != nil {
+		slog.Error("invalid log date", "date", last.String, "err", err)
+
+		return noticeReminder
+	}
+	t, err := time.Parse(time.DateOnly, date)
+	if err != nil {
+		slog.Error("invalid log date", "date", date, "err", err)
+
+		return noticeReminder
+	}
+
+	if t.Sub(lt) < *notifyRemind {
+		slog.Debug("same failure as before, reminder not due", "attr_path", attr_path, "last", last.String)
+
+		return ""
+	}
+
+	return noticeReminder
+}
+
+// Wraps text in a markdown code block, using a fence that doesn't occur in it.
+func codeBlock(text string) string {
+	fence := "```"
+	for strings.Contains(text, fence) {
+		fence += "`"
+	}
+
+	return fmt.Sprintf("%s\n%s\n%s", fence, text, fence)
+}
+
+func isOptIn(kind noticeKind) bool {
+	_, ok := optInNotices[kind]
+
+	return ok
+}
+
+// Returns whether a room muted notices about a log, with one of its filters
+// matching the log's excerpt.
+func isFiltered(ctx context.Context, roomID string, l logEntry) bool {
+	text := l.Excerpt
+	if text == "" {
+		text = strings.Join(l.Matches, "\n")
+	}
+	if text == "" {
+		return false
+	}
+
+	rows, err := clients.db.QueryContext(ctx, "SELECT id, pattern FROM filters WHERE roomid = ?", roomID)
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var pattern string
+		if err := rows.Scan(&id, &pattern); err != nil {
+			panic(err)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			slog.Error("invalid filter", "id", id, "pattern", pattern, "err", err)
+
+			continue
+		}
+		if re.MatchString(text) {
+			slog.Info("notice muted by filter", "roomid", roomID, "filter", id, "date", l.Date)
+
+			return true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	return false
+}
@@ -10,19 +10,25 @@ import "regexp"
 //
 // Unsubbing with the same queries is OK, because it it has different semantics and doesn't spam upstream.
 var (
-	dangerous = regexp.MustCompile(`^(?i:sub) (?:[*?]+|\w+\.\*)$`)
-	subscribe = regexp.MustCompile(`^(?i:(un)?sub) ([\w_?*.-]+)$`)
-	follow    = regexp.MustCompile(`^(?i:(un)?follow) (\w+)$`)
+	dangerous = regexp.MustCompile(`^(?i:sub) (?:.*[ ,])?(?:[*?]+|\w+\.\*)(?:[ ,].*)?$`)
+	subscribe = regexp.MustCompile(`^(?i:(un)?sub) ([\w_?*.-]+(?:(?: *, *| +)[\w_?*.-]+)*)$`)
+	follow    = regexp.MustCompile(`^(?i:(un)?follow) (?:(?i:team):([\w-]+)(?: (?i:(members)))?|(\w+))$`)
+	notify    = regexp.MustCompile(`^(?i:notify)(?: (\w+) (?i:(on|off)))?$`)
+	feedback  = regexp.MustCompile(`^(?i:(notanerror|missederror)) ([\w.-]+)(?: (\d{4}-\d{2}-\d{2}))?$`)
+	status    = regexp.MustCompile(`^(?i:status) ([\w_?*.-]+)$`)
+	search    = regexp.MustCompile(`^(?i:search) (\S+)(?: (\d+))?$`)
+	mute      = regexp.MustCompile(`^(?i:(un)?mute) ([\w_?*.-]+)(?: (\d+[hdw]|(?i:until-fixed)))?$`)
+	digest    = regexp.MustCompile(`^(?i:digest)(?: (?:(?i:(daily))(?: (\d{2}:\d{2}))?|(?i:(weekly)) (?i:(mon|tue|wed|thu|fri|sat|sun))(?: (\d{2}:\d{2}))?|(?i:(off))))?$`)
+	filter    = regexp.MustCompile(`^(?i:filter) (?:(?i:(add)) (.+)|(?i:(list))|(?i:(rm)) (\d+))$`)
 )
 
-// These two regexps are for parsing logs.
-// - "error: " is a nix build error
-// - "ExitFailure" is a nixpkgs-update error
-// - "failed with" is a nixpkgs/maintainers/scripts/update.py error
-var (
-	error  = regexp.MustCompile(`^error:|ExitFailure|failed with`)
-	ignore = regexp.MustCompile(`^~.*|^\.\.`)
-)
+// indexDate matches the modification time that follows each link on the
+// main page's autoindex listing, e.g. "10-Dec-2024 03:14".
+var indexDate = regexp.MustCompile(`\d{2}-\w{3}-\d{4} \d{2}:\d{2}`)
+
+// ignore matches links on the main page that aren't packages.
+// Logs themselves are parsed by the classifier package.
+var ignore = regexp.MustCompile(`^~.*|^\.\.`)
 
 func Dangerous() *regexp.Regexp {
 	return dangerous
@@ -36,14 +42,42 @@ func Follow() *regexp.Regexp {
 	return follow
 }
 
-func Error() *regexp.Regexp {
-	return error
+func Notify() *regexp.Regexp {
+	return notify
+}
+
+func Feedback() *regexp.Regexp {
+	return feedback
+}
+
+func Status() *regexp.Regexp {
+	return status
+}
+
+func Search() *regexp.Regexp {
+	return search
+}
+
+func Mute() *regexp.Regexp {
+	return mute
+}
+
+func Digest() *regexp.Regexp {
+	return digest
+}
+
+func Filter() *regexp.Regexp {
+	return filter
 }
 
 func Ignore() *regexp.Regexp {
 	return ignore
 }
 
+func IndexDate() *regexp.Regexp {
+	return indexDate
+}
+
 type normalization struct {
 	pattern     *regexp.Regexp
 	replacement string
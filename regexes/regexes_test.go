@@ -4,39 +4,6 @@ import (
 	"testing"
 )
 
-func TestErrRegexp(t *testing.T) {
-	positives := []string{
-		// https://nixpkgs-update-logs.nix-community.org/grafana-dash-n-grab/2024-09-13.log
-		"error: attribute 'originalSrc' in selection path 'grafana-dash-n-grab.originalSrc' not found",
-		// https://nixpkgs-update-logs.nix-community.org/babashka/2024-09-13.log
-		"Received ExitFailure 1 when running",
-		// https://nixpkgs-update-logs.nix-community.org/php83Extensions.ssh2/2024-09-19.log
-		"The update script for php-ssh2-1.3.1 failed with exit code 1",
-		// https://nixpkgs-update-logs.nix-community.org/kyverno-chainsaw/2024-09-19.log
-		"error: builder for '/nix/store/gxvr06ifbpw342msbqbjd89fv8572kdr-kyverno-chainsaw-0.2.10-go-modules.drv' failed with exit code 1;",
-	}
-	for _, s := range positives {
-		if Error().FindString(s) == "" {
-			t.Errorf("should have matched: %s", s)
-		}
-	}
-
-	falsePositives := []string{
-		// https://nixpkgs-update-logs.nix-community.org/glibc/2024-08-05.log
-		`"configure: error: Pthreads are required to build libgomp"`,
-		// https://nixpkgs-update-logs.nix-community.org/rPackages.MBESS/2023-12-24.log
-		`"flock ${xvfb-run} xvfb-run -a -e xvfb-error R"`,
-		// https://nixpkgs-update-logs.nix-community.org/testlib/2024-09-13.log
-		`copying nixpkgs_review/errors.py -> build/lib/nixpkgs_review`,
-	}
-
-	for _, s := range falsePositives {
-		if Error().FindString(s) != "" {
-			t.Errorf("should not have matched: %s", s)
-		}
-	}
-}
-
 func TestSubUnsubRegexp(t *testing.T) {
 	t.Run("should match", func(t *testing.T) {
 		ss := []string{
@@ -59,6 +26,11 @@ func TestSubUnsubRegexp(t *testing.T) {
 			"UNSUB foo",
 			"uNsUb foo",
 			"UnSuB foo",
+			// Multiple patterns
+			"sub foo bar",
+			"sub foo,bar",
+			"sub foo, *.bar baz",
+			"unsub foo bar",
 		}
 
 		for _, s := range ss {
@@ -72,6 +44,8 @@ func TestSubUnsubRegexp(t *testing.T) {
 		ss := []string{
 			"subx foo",
 			"unsuby foo",
+			"sub foo,",
+			"sub foo;bar",
 		}
 
 		for _, s := range ss {
@@ -95,6 +69,9 @@ func TestDangerousRegexp(t *testing.T) {
 		"SUB *",
 		"sUb pythonPackages.*",
 		"Sub pythonPackages.*",
+		// Multiple patterns
+		"sub foo *",
+		"sub foo,pythonPackages.* bar",
 	}
 
 	for _, s := range ss {
@@ -102,6 +79,12 @@ func TestDangerousRegexp(t *testing.T) {
 			t.Errorf("should have matched: %s", s)
 		}
 	}
+
+	for _, s := range []string{"sub *.foo", "sub foo *.bar", "sub foo?"} {
+		if Dangerous().MatchString(s) {
+			t.Errorf("should not have matched: %s", s)
+		}
+	}
 }
 
 func TestFollowRegexp(t *testing.T) {
@@ -117,6 +100,10 @@ func TestFollowRegexp(t *testing.T) {
 			"UNFOLLOW bar",
 			"uNfOlLoW bar",
 			"UnFoLlOw bar",
+			// Teams
+			"follow team:nix",
+			"follow team:nix-team members",
+			"unfollow Team:nix Members",
 		}
 		for _, s := range ss {
 			if !Follow().MatchString(s) {
@@ -137,6 +124,9 @@ func TestFollowRegexp(t *testing.T) {
 			"unfollowy bar",
 			"follows foo",
 			"unfollows bar",
+			"follow team:",
+			"follow team:nix foo",
+			"follow foo members",
 		}
 
 		for _, s := range ss {
@@ -193,3 +183,161 @@ func TestNormalizeAttrPath(t *testing.T) {
 		})
 	}
 }
+
+func TestIndexDateRegexp(t *testing.T) {
+	s := `                                    10-Dec-2024 03:14       -`
+	if got, expected := IndexDate().FindString(s), "10-Dec-2024 03:14"; got != expected {
+		t.Errorf("expected: %s; got: %s", expected, got)
+	}
+
+	if got := IndexDate().FindString("\n"); got != "" {
+		t.Errorf("should not have matched: %s", got)
+	}
+}
+
+func TestNotifyRegexp(t *testing.T) {
+	t.Run("should match", func(t *testing.T) {
+		ss := []string{
+			"notify",
+			"notify fixed on",
+			"notify fixed off",
+			"Notify fixed ON",
+		}
+		for _, s := range ss {
+			if !Notify().MatchString(s) {
+				t.Errorf("should have matched: %s", s)
+			}
+		}
+	})
+
+	t.Run("should not match", func(t *testing.T) {
+		ss := []string{
+			"notify fixed",
+			"notify fixed maybe",
+			"notifyx",
+		}
+		for _, s := range ss {
+			if Notify().MatchString(s) {
+				t.Errorf("should not have matched: %s", s)
+			}
+		}
+	})
+}
+
+func TestFeedbackRegexp(t *testing.T) {
+	t.Run("should match", func(t *testing.T) {
+		ss := []string{
+			"notanerror foo",
+			"notanerror python3Packages.foo-bar 2024-12-10",
+			"missederror foo",
+			"MissedError foo 2024-12-10",
+		}
+		for _, s := range ss {
+			if !Feedback().MatchString(s) {
+				t.Errorf("should have matched: %s", s)
+			}
+		}
+	})
+
+	t.Run("should not match", func(t *testing.T) {
+		ss := []string{
+			"notanerror",
+			"notanerror foo*",
+			"notanerror foo yesterday",
+			"missederrors foo",
+		}
+		for _, s := range ss {
+			if Feedback().MatchString(s) {
+				t.Errorf("should not have matched: %s", s)
+			}
+		}
+	})
+}
+
+func TestStatusRegexp(t *testing.T) {
+	for _, s := range []string{"status foo", "Status python3Packages.foo-bar", "status *.acme"} {
+		if !Status().MatchString(s) {
+			t.Errorf("should have matched: %s", s)
+		}
+	}
+
+	for _, s := range []string{"status", "status foo bar", "statuses foo"} {
+		if Status().MatchString(s) {
+			t.Errorf("should not have matched: %s", s)
+		}
+	}
+}
+
+func TestSearchRegexp(t *testing.T) {
+	for _, s := range []string{"search foo", "search *.acme 2", "Search /^foo[0-9]+$/"} {
+		if !Search().MatchString(s) {
+			t.Errorf("should have matched: %s", s)
+		}
+	}
+
+	for _, s := range []string{"search", "search foo bar", "search foo -1"} {
+		if Search().MatchString(s) {
+			t.Errorf("should not have matched: %s", s)
+		}
+	}
+}
+
+func TestFilterRegexp(t *testing.T) {
+	t.Run("should match", func(t *testing.T) {
+		ss := []string{
+			"filter add ^foo.*bar$",
+			"filter add no updates found",
+			"Filter List",
+			"filter list",
+			"filter rm 12",
+		}
+		for _, s := range ss {
+			if !Filter().MatchString(s) {
+				t.Errorf("should have matched: %s", s)
+			}
+		}
+	})
+
+	t.Run("should not match", func(t *testing.T) {
+		ss := []string{
+			"filter",
+			"filter add",
+			"filter list foo",
+			"filter rm foo",
+			"filters list",
+		}
+		for _, s := range ss {
+			if Filter().MatchString(s) {
+				t.Errorf("should not have matched: %s", s)
+			}
+		}
+	})
+}
+
+func TestMuteRegexp(t *testing.T) {
+	for _, s := range []string{"mute foo 7d", "mute *.acme 12h", "Mute foo Until-Fixed", "unmute foo", "mute foo"} {
+		if !Mute().MatchString(s) {
+			t.Errorf("should have matched: %s", s)
+		}
+	}
+
+	for _, s := range []string{"mute", "mute foo 7", "mute foo 7m", "unmute foo bar", "mutes foo 1d"} {
+		if Mute().MatchString(s) {
+			t.Errorf("should not have matched: %s", s)
+		}
+	}
+}
+
+func TestDigestRegexp(t *testing.T) {
+	for _, s := range []string{"digest", "digest daily", "digest daily 09:00", "Digest Weekly Mon", "digest weekly fri 18:30", "digest off"} {
+		if !Digest().MatchString(s) {
+			t.Errorf("should have matched: %s", s)
+		}
+	}
+
+	for _, s := range []string{"digest weekly", "digest daily 9", "digest weekly monday", "digest on", "digests"} {
+		if Digest().MatchString(s) {
+			t.Errorf("should not have matched: %s", s)
+		}
+	}
+}
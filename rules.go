@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// ruleKind is what a rule subscribes a room to.
+type ruleKind string
+
+const (
+	// Packages maintained by a GitHub handle.
+	ruleMaintainer ruleKind = "maintainer"
+	// Packages owned by a nixpkgs team.
+	ruleTeam ruleKind = "team"
+	// Packages matching a glob pattern, e.g. *.acme
+	ruleGlob ruleKind = "glob"
+)
+
+// A rule keeps a room subscribed to a changing set of packages, e.g. those
+// maintained by someone.
+type rule struct {
+	id     int64
+	roomid string
+	mxid   string
+	kind   ruleKind
+	value  string
+	// for teams, whether packages maintained by its members are included
+	members bool
+}
+
+func (r rule) String() string {
+	return fmt.Sprintf("%s `%s`", r.kind, r.value)
+}
+
+// Returns the value as stored: handles and team names are case-insensitive,
+// globs aren't.
+func (r rule) normalizedValue() string {
+	if r.kind == ruleGlob {
+		return r.value
+	}
+
+	return strings.ToLower(r.value)
+}
+
+// Returns the tracked packages the rule currently covers.
+func (r rule) expand(ctx context.Context) ([]string, error) {
+	switch r.kind {
+	case ruleMaintainer, ruleTeam:
+		// without packages.json, it would look like all packages were dropped
+		if !haveJSONBlob() {
+			return nil, errors.New("packages.json not fetched yet")
+		}
+		if r.kind == ruleTeam {
+			return findPackagesForTeam(ctx, r.value, r.members)
+		}
+
+		return findPackagesForHandle(ctx, r.value)
+	case ruleGlob:
+		return matchPackages(ctx, r.value)
+	default:
+		return nil, fmt.Errorf("unknown rule kind %q", r.kind)
+	}
+}
+
+// Stores a rule, returning its ID. If the room already has the same rule, it's
+// updated, and packages excluded from it are included again.
+func saveRule(ctx context.Context, r rule) (int64, error) {
+	var id int64
+	if err := clients.db.QueryRowContext(ctx, `
+    INSERT INTO rules(roomid, mxid, kind, value, members) VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT(roomid, kind, value) DO UPDATE SET members = excluded.members
+    RETURNING id`, r.roomid, r.mxid, r.kind, r.normalizedValue(), r.members).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	_, err := clients.db.ExecContext(ctx, "DELETE FROM rule_exclusions WHERE rule_id = ?", id)
+
+	return id, err
+}
+
+// Returns the ID of the room's rule with the same kind and value as r, and
+// whether there is one.
+func findRule(ctx context.Context, r rule) (int64, bool, error) {
+	var id int64
+	err := clients.db.QueryRowContext(ctx, "SELECT id FROM rules WHERE roomid = ? AND kind = ? AND value = ?", r.roomid, r.kind, r.normalizedValue()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+
+	return id, err == nil, err
+}
+
+// Deletes a room's rule, and the subscriptions it added.
+func deleteRule(ctx context.Context, r rule) error {
+	_, err := clients.db.ExecContext(ctx, "DELETE FROM rules WHERE roomid = ? AND kind = ? AND value = ?", r.roomid, r.kind, r.normalizedValue())
+
+	return err
+}
+
+// Deletes a room's glob rules that are covered by pattern, e.g. `*.acme` and
+// `*acme` by `*`, and the subscriptions they added. A rule is covered if
+// pattern matches the rule's own pattern.
+func deleteCoveredGlobRules(ctx context.Context, roomid, pattern string) error {
+	_, err := clients.db.ExecContext(ctx, "DELETE FROM rules WHERE roomid = ? AND kind = ? AND value GLOB ?", roomid, ruleGlob, pattern)
+
+	return err
+}
+
+// Returns the rules of the given kinds, oldest first, for a room or, if roomid
+// is empty, for all rooms.
+func listRules(ctx context.Context, roomid string, kinds ...ruleKind) ([]rule, error) {
+	rows, err := clients.db.QueryContext(ctx, "SELECT id, roomid, mxid, kind, value, members FROM rules WHERE ? IN ('', roomid) ORDER BY id", roomid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []rule
+	for rows.Next() {
+		var r rule
+		if err := rows.Scan(&r.id, &r.roomid, &r.mxid, &r.kind, &r.value, &r.members); err != nil {
+			return nil, err
+		}
+		if slices.Contains(kinds, r.kind) {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules, rows.Err()
+}
+
+// Returns the packages subscribed to because of a rule, or, if excluded is
+// true, the ones unsubscribed from despite the rule.
+func ruleSubscriptions(ctx context.Context, id int64, excluded bool) ([]string, error) {
+	query := "SELECT attr_path FROM subscriptions WHERE rule_id = ? ORDER BY attr_path"
+	if excluded {
+		query = "SELECT attr_path FROM rule_exclusions WHERE rule_id = ? ORDER BY attr_path"
+	}
+
+	rows, err := clients.db.QueryContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aps []string
+	for rows.Next() {
+		var ap string
+		if err := rows.Scan(&ap); err != nil {
+			return nil, err
+		}
+		aps = append(aps, ap)
+	}
+
+	return aps, rows.Err()
+}
+
+// reconcileRules re-evaluates the rules of the given kinds, subscribing rooms
+// to packages their rules now cover, and unsubscribing them from the ones they
+// don't cover anymore. Rooms are sent a summary of what changed.
+//
+// Subscriptions that weren't added by a rule are never touched.
+func reconcileRules(ctx context.Context, kinds ...ruleKind) {
+	rules, err := listRules(ctx, "", kinds...)
+	if err != nil {
+		fatal(err)
+	}
+
+	// rules with the same kind and value expand to the same packages
+	type key struct {
+		kind    ruleKind
+		value   string
+		members bool
+	}
+	cache := make(map[key][]string)
+	expansions := make(map[int64][]string)
+	for _, r := range rules {
+		k := key{r.kind, r.value, r.members}
+		aps, ok := cache[k]
+		if !ok {
+			aps, err = r.expand(ctx)
+			if err != nil {
+				slog.Error("expanding rule, skipping", "rule", r.id, "err", err)
+
+				continue
+			}
+			cache[k] = aps
+		}
+		expansions[r.id] = aps
+	}
+
+	// Returns another rule of the same room covering ap.
+	otherRule := func(r rule, ap string) (int64, bool) {
+		for _, o := range rules {
+			if o.id != r.id && o.roomid == r.roomid && slices.Contains(expansions[o.id], ap) {
+				return o.id, true
+			}
+		}
+
+		return 0, false
+	}
+
+	for _, r := range rules {
+		expanded, ok := expansions[r.id]
+		if !ok {
+			continue
+		}
+
+		current, err := ruleSubscriptions(ctx, r.id, false)
+		if err != nil {
+			fatal(err)
+		}
+		excluded, err := ruleSubscriptions(ctx, r.id, true)
+		if err != nil {
+			fatal(err)
+		}
+
+		var added, removed []string
+		for _, ap := range expanded {
+			if slices.Contains(current, ap) || slices.Contains(excluded, ap) {
+				continue
+			}
+
+			var esErr existingSubscriptionError
+			var noLogsErr *NoLogsError
+			if err := addSubscription(ctx, ap, r.roomid, r.mxid, r.id); errors.As(err, &esErr) {
+				// e.g. subscribed to manually
+				continue
+			} else if errors.As(err, &noLogsErr) {
+				slog.Info("package has no logs yet, will retry", "ap", ap, "rule", r.id)
+
+				continue
+			} else if isNetworkError(err) {
+				slog.Warn("network error while subscribing to package, will retry", "ap", ap, "rule", r.id, "err", err)
+
+				continue
+			} else if err != nil {
+				fatal(err)
+			}
+
+			added = append(added, ap)
+		}
+
+		for _, ap := range current {
+			if slices.Contains(expanded, ap) {
+				continue
+			}
+
+			// keep the subscription if another rule still wants it
+			var err error
+			if other, ok := otherRule(r, ap); ok {
+				_, err = clients.db.ExecContext(ctx, "UPDATE subscriptions SET rule_id = ? WHERE rule_id = ? AND attr_path = ?", other, r.id, ap)
+			} else {
+				_, err = clients.db.ExecContext(ctx, "DELETE FROM subscriptions WHERE rule_id = ? AND attr_path = ?", r.id, ap)
+				removed = append(removed, ap)
+			}
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+
+		slog.Info("rule changed", "rule", r.id, "roomid", r.roomid, "added", len(added), "removed", len(removed))
+
+		if r.kind == ruleGlob && len(removed) == 0 {
+			send(ctx, fmt.Sprintf("Now also watching packages matching `%s`:\n%s", r.value, strings.Join(formatPackageList(added), "\n")), r.roomid)
+
+			continue
+		}
+
+		parts := []string{fmt.Sprintf("The packages of %s changed.", r)}
+		if len(added) > 0 {
+			parts = append(parts, fmt.Sprintf("Subscribed to:\n%s", strings.Join(formatPackageList(added), "\n")))
+		}
+		if len(removed) > 0 {
+			parts = append(parts, fmt.Sprintf("Unsubscribed from:\n%s", strings.Join(formatPackageList(removed), "\n")))
+		}
+		send(ctx, strings.Join(parts, "\n\n"), r.roomid)
+	}
+}
+
+// Returns whether packages.json has been fetched.
+func haveJSONBlob() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return len(jsblob) > 0
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestReconcileRules(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+	stubJSONBlob()
+	defer stubJSONBlob()
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "1999", nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	addPackages("btrbk", "diceware", "nix", "foo")
+	sub("nix")
+	fol("asymmetric")
+
+	subs := func() []string {
+		var aps []string
+		for _, ap := range []string{"btrbk", "diceware", "evmdis", "nix", "foo"} {
+			if exists, err := checkIfSubExists(ctx, ap, evt.RoomID.String()); err != nil {
+				panic(err)
+			} else if exists {
+				aps = append(aps, ap)
+			}
+		}
+		return aps
+	}
+	if expected := []string{"btrbk", "diceware", "nix"}; !slices.Equal(expected, subs()) {
+		t.Fatalf("expected: %v\ngot: %v", expected, subs())
+	}
+
+	// asymmetric stops maintaining btrbk, and starts maintaining nix and a newly
+	// tracked package
+	setMaintainers("btrbk")
+	setMaintainers("nix", "asymmetric")
+	addPackages("evmdis")
+
+	sent = nil
+	reconcileRules(ctx, ruleMaintainer, ruleTeam)
+
+	if expected := []string{"diceware", "evmdis", "nix"}; !slices.Equal(expected, subs()) {
+		t.Errorf("expected: %v\ngot: %v", expected, subs())
+	}
+	expected := []string{"The packages of maintainer `asymmetric` changed.\n\nSubscribed to:\n- `evmdis`\n\nUnsubscribed from:\n- `btrbk`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	t.Run("unsubscribed packages stay unsubscribed", func(t *testing.T) {
+		unsub("diceware")
+
+		sent = nil
+		reconcileRules(ctx, ruleMaintainer, ruleTeam)
+
+		if expected := []string{"evmdis", "nix"}; !slices.Equal(expected, subs()) {
+			t.Errorf("expected: %v\ngot: %v", expected, subs())
+		}
+		if len(sent) != 0 {
+			t.Errorf("expected no messages, got: %q", sent)
+		}
+	})
+
+	t.Run("unfollow", func(t *testing.T) {
+		unfol("asymmetric")
+
+		rules, err := listRules(ctx, "", ruleMaintainer)
+		if err != nil {
+			panic(err)
+		}
+		if len(rules) != 0 {
+			t.Errorf("expected no rules, got: %v", rules)
+		}
+	})
+}
+
+// Replaces the GitHub handles of a package's maintainers in the JSON blob.
+func setMaintainers(ap string, handles ...string) {
+	maintainers := make([]any, 0, len(handles))
+	for _, h := range handles {
+		maintainers = append(maintainers, map[string]any{"github": h})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	meta := jsblob["packages"].(map[string]any)[ap].(map[string]any)["meta"].(map[string]any)
+	meta["maintainers"] = maintainers
+}
+
+func TestGlobRules(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	var sent []string
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "1999", nil
+		},
+		sender: captureSender(&sent),
+	}
+
+	addPackages("acme", "python3Packages.acme", "foo")
+	sub("*acme foo")
+
+	// a new package shows up on the main page
+	addPackages("haskellPackages.acme")
+
+	sent = nil
+	reconcileRules(ctx, ruleGlob)
+
+	expected := []string{"Now also watching packages matching `*acme`:\n- `haskellPackages.acme`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	sent = nil
+	message("subs")
+
+	expected = []string{"Your subscriptions:\n\n- `foo`\n\nYour rules:\n\n- glob `*acme`\n  - `acme`\n  - `haskellPackages.acme`\n  - `python3Packages.acme`"}
+	if !slices.Equal(expected, sent) {
+		t.Errorf("expected: %q\ngot: %q", expected, sent)
+	}
+
+	t.Run("package without logs", func(t *testing.T) {
+		dateFetcher := h.dateFetcher
+		defer func() { h.dateFetcher = dateFetcher }()
+		h.dateFetcher = func(ctx context.Context, url string) (string, error) {
+			return "", &NoLogsError{URL: url}
+		}
+
+		addPackages("rust-acme")
+		sent = nil
+		reconcileRules(ctx, ruleGlob)
+
+		if exists, _ := checkIfSubExists(ctx, "rust-acme", evt.RoomID.String()); exists {
+			t.Error("should not be subscribed to a package without logs")
+		}
+		if len(sent) != 0 {
+			t.Errorf("expected no messages, got: %q", sent)
+		}
+	})
+
+	t.Run("unsub", func(t *testing.T) {
+		unsub("*acme")
+		addPackages("nodePackages.acme")
+		reconcileRules(ctx, ruleGlob)
+
+		if exists, _ := checkIfSubExists(ctx, "nodePackages.acme", evt.RoomID.String()); exists {
+			t.Error("should not be subscribed after removing the rule")
+		}
+	})
+}
+
+func TestUnsubCoveredGlobRules(t *testing.T) {
+	if err := setupDB(ctx, ":memory:"); err != nil {
+		panic(err)
+	}
+
+	h = handlers{
+		dateFetcher: func(ctx context.Context, url string) (string, error) {
+			return "1999", nil
+		},
+		sender: testSender,
+	}
+
+	addPackages("python3Packages.acme", "foo")
+	sub("*.acme foo*")
+	// covers *.acme, but not foo*
+	unsub("*.*")
+
+	addPackages("rPackages.acme", "foobar")
+	reconcileRules(ctx, ruleGlob)
+
+	if exists, _ := checkIfSubExists(ctx, "rPackages.acme", evt.RoomID.String()); exists {
+		t.Error("should not be subscribed after removing a covering pattern")
+	}
+	if exists, _ := checkIfSubExists(ctx, "foobar", evt.RoomID.String()); !exists {
+		t.Error("should be subscribed by a rule that isn't covered")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"time"
+)
+
+var scheduleMin = flag.Duration("schedule.min", 6*time.Hour, "Minimum interval between checks of a package")
+var scheduleMax = flag.Duration("schedule.max", 7*24*time.Hour, "Maximum interval between checks of a package")
+
+// How many of the most recent logs are used to estimate a package's cadence.
+const cadenceWindow = 10
+
+// nextCheckInterval returns how long to wait before checking a package again,
+// given the dates of its logs, oldest first. Packages are also checked as soon
+// as their directory is modified, see updateSubs.
+//
+// The estimate is half the median interval between recent logs, so that a new
+// log is noticed within half a cycle. If the latest log is older than the
+// median, that age is used instead, so that dormant packages are checked less
+// and less often. The result is clamped to [-schedule.min, -schedule.max].
+func nextCheckInterval(dates []string, now time.Time) time.Duration {
+	var ts []time.Time
+	for _, d := range dates {
+		if t, err := time.Parse(time.DateOnly, d); err == nil {
+			ts = append(ts, t)
+		}
+	}
+	if len(ts) < 2 {
+		return *scheduleMax
+	}
+
+	ts = ts[max(len(ts)-cadenceWindow, 0):]
+	gaps := make([]time.Duration, 0, len(ts)-1)
+	for i := 1; i < len(ts); i++ {
+		gaps = append(gaps, ts[i].Sub(ts[i-1]))
+	}
+	slices.Sort(gaps)
+	median := gaps[len(gaps)/2]
+
+	interval := max(median, now.Sub(ts[len(ts)-1])) / 2
+
+	return min(max(interval, *scheduleMin), *scheduleMax)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextCheckInterval(t *testing.T) {
+	now := time.Date(2024, 12, 10, 12, 0, 0, 0, time.UTC)
+
+	tt := []struct {
+		name     string
+		dates    []string
+		expected time.Duration
+	}{
+		{
+			name:     "no history",
+			dates:    nil,
+			expected: *scheduleMax,
+		},
+		{
+			name:     "single log",
+			dates:    []string{"2024-12-09"},
+			expected: *scheduleMax,
+		},
+		{
+			name:     "daily",
+			dates:    []string{"2024-12-07", "2024-12-08", "2024-12-09", "2024-12-10"},
+			expected: 12 * time.Hour,
+		},
+		{
+			name:     "every four days",
+			dates:    []string{"2024-11-26", "2024-11-30", "2024-12-04", "2024-12-08"},
+			expected: 48 * time.Hour,
+		},
+		{
+			name:     "dormant",
+			dates:    []string{"2024-01-01", "2024-01-02", "2024-01-03"},
+			expected: *scheduleMax,
+		},
+		{
+			name:     "more often than the minimum",
+			dates:    []string{"2024-12-10", "2024-12-10", "2024-12-10"},
+			expected: *scheduleMin,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := nextCheckInterval(tc.dates, now); got != tc.expected {
+				t.Errorf("expected: %s; got: %s", tc.expected, got)
+			}
+		})
+	}
+}
@@ -52,6 +52,21 @@ func setupMatrix() *mautrix.Client {
 			if _, err := clients.db.Exec("DELETE FROM subscriptions WHERE roomid = ?", evt.RoomID); err != nil {
 				panic(err)
 			}
+			if _, err := clients.db.Exec("DELETE FROM opt_ins WHERE roomid = ?", evt.RoomID); err != nil {
+				panic(err)
+			}
+			if _, err := clients.db.Exec("DELETE FROM filters WHERE roomid = ?", evt.RoomID); err != nil {
+				panic(err)
+			}
+			if _, err := clients.db.Exec("DELETE FROM rules WHERE roomid = ?", evt.RoomID); err != nil {
+				panic(err)
+			}
+			if _, err := clients.db.Exec("DELETE FROM digests WHERE roomid = ?", evt.RoomID); err != nil {
+				panic(err)
+			}
+			if _, err := clients.db.Exec("DELETE FROM digest_queue WHERE roomid = ?", evt.RoomID); err != nil {
+				panic(err)
+			}
 
 			if _, err := client.LeaveRoom(ctx, evt.RoomID); err != nil {
 				slog.Error(err.Error())
@@ -98,9 +113,57 @@ func setupDB(ctx context.Context, path string) (err error) {
 		return
 	}
 
+	err = addColumns(ctx)
+
 	return
 }
 
+// Columns added to tables after they were first created.
+//
+// They're also part of schema.sql, so they only need to be added to DBs that
+// predate them.
+var newColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"subscriptions", "rule_id", "INTEGER REFERENCES rules(id) ON DELETE CASCADE"},
+	{"subscriptions", "muted_until", "TEXT"},
+	{"subscriptions", "muted_until_fixed", "INTEGER NOT NULL DEFAULT 0"},
+	{"packages", "last_modified", "TEXT"},
+	{"packages", "next_check", "TEXT"},
+	{"packages", "checked_modified", "TEXT"},
+	{"logs", "excerpt", "TEXT"},
+	{"logs", "category", "TEXT"},
+	{"logs", "rule", "TEXT"},
+	{"logs", "old_version", "TEXT"},
+	{"logs", "new_version", "TEXT"},
+	{"logs", "update_url", "TEXT"},
+	{"logs", "pr_url", "TEXT"},
+	{"logs", "outcome", "TEXT"},
+	{"logs", "fingerprint", "TEXT"},
+	{"logs", "notified", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func addColumns(ctx context.Context) error {
+	for _, c := range newColumns {
+		var exists bool
+		if err := clients.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", c.table, c.column).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		slog.Info("adding column", "table", c.table, "column", c.column)
+		if _, err := clients.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func setupLogger() {
 	opts := &slog.HandlerOptions{}
 
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
@@ -26,9 +25,25 @@ These are the available commands:
 
 - **sub foo**: subscribe to package <code>foo</code>
 - **unsub foo**: unsubscribe from package <code>foo</code>
+- **sub foo bar**: subscribe to several packages at once (also works with <code>unsub</code>, and with commas)
 - **follow foo**: subscribe to all packages maintained by GitHub handle <code>foo</code>
 - **unfollow foo**: unsubscribe to all packages maintained by GitHub handle <code>foo</code>
-- **subs**: list subscriptions
+- **follow team:foo**: subscribe to all packages of nixpkgs team <code>foo</code>, e.g. <code>team:nix</code> (append <code>members</code> to also include packages maintained by its members, and use <code>unfollow</code> to unsubscribe)
+- **subs**: list subscriptions, and the follows and globs that added them
+- **mute foo 7d**: mute notifications for package <code>foo</code> for 7 days (or <code>12h</code>, <code>2w</code>, or <code>until-fixed</code> to mute until it builds again)
+- **unmute foo**: unmute notifications for package <code>foo</code>
+- **status foo**: show the latest log of package <code>foo</code> (globs work too)
+- **search foo**: list packages whose name contains <code>foo</code>, matches a glob like <code>*.foo</code>, or a regex like <code>/^foo[0-9]+$/</code> (append a number for more pages)
+- **notify fixed on**: also get notified when a failing package builds again (<code>off</code> to disable)
+- **notify pr on**: also get notified when r-ryantm opens a pull request for a package (<code>off</code> to disable)
+- **notify**: list optional notifications
+- **digest daily 09:00**: receive failures in a daily summary at 09:00 UTC (or <code>digest weekly mon 09:00</code>, with the time being optional)
+- **digest off**: receive failures as they happen again
+- **filter add foo**: mute failures whose log excerpt matches the regex <code>foo</code>
+- **filter list**: list filters
+- **filter rm 1**: remove filter number <code>1</code>
+- **notanerror foo**: report that the latest log of <code>foo</code> was wrongly reported as a failure (append a date like <code>2024-12-10</code> for an older log)
+- **missederror foo**: report that the latest log of <code>foo</code> is a failure the bot missed
 - **help**: show this help message
 
 You can use the <code>*</code> and <code>?</code> globs in queries. Things you can do:
@@ -55,6 +70,15 @@ func (e *HTTPError) Error() string {
 	return fmt.Sprintf("HTTP error: %d - %s", e.StatusCode, e.Body)
 }
 
+// NoLogsError is returned when a package's page doesn't list any logs.
+type NoLogsError struct {
+	URL string
+}
+
+func (e *NoLogsError) Error() string {
+	return fmt.Sprintf("no logs found for %s", e.URL)
+}
+
 func newReqWithUA(ctx context.Context, url string) (*http.Request, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -65,33 +89,6 @@ func newReqWithUA(ctx context.Context, url string) (*http.Request, error) {
 	return req, nil
 }
 
-func makeRequest(ctx context.Context, url string) ([]byte, error) {
-	req, err := newReqWithUA(ctx, url)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := clients.http.Do(req)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("reading response body: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, &HTTPError{
-			StatusCode: resp.StatusCode,
-			Body:       string(body),
-		}
-	}
-
-	return body, nil
-}
-
 func sendMarkdown(ctx context.Context, text string, rid id.RoomID) (*mautrix.RespSendEvent, error) {
 	md := format.RenderMarkdown(text, true, true)
 	return clients.matrix.SendMessageEvent(ctx, rid, event.EventMessage, md)
@@ -119,36 +116,81 @@ func logURL(attr_path, date string) string {
 	return fmt.Sprintf("%s/%s.log", purl, date)
 }
 
+// Whether mxid is listed in -admins.
+func isAdmin(mxid id.UserID) bool {
+	for _, a := range strings.Split(*admins, ",") {
+		if a = strings.TrimSpace(a); a != "" && a == mxid.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
 // This one should be used if there's an irrecoverable problem, e.g. IO with the DB.
 func fatal(err error) {
 	slog.Error("error", "err", err)
 	os.Exit(restartExitCode)
 }
 
-// TODO: log duration of the whole thing to Info
-// Fetches the packages.json.br, unpacks it and parses it.
-func fetchPackagesJSON(ctx context.Context) {
+// Validators of the last fetched packages.json.br, to only download it again
+// when it changed.
+var jsblobValidators struct {
+	etag         string
+	lastModified string
+}
+
+// Fetches the packages.json.br, unpacks it and parses it, returning whether it
+// changed since the last time.
+//
+// On failure, the previously fetched packages.json is kept.
+func fetchPackagesJSON(ctx context.Context) (bool, error) {
 	slog.Debug("downloading packages.json.br")
 
 	start := time.Now()
-	req, err := http.NewRequestWithContext(ctx, "GET", packagesURL, nil)
+	req, err := newReqWithUA(ctx, packagesURL)
 	if err != nil {
-		panic(err)
+		return false, err
+	}
+	if jsblobValidators.etag != "" {
+		req.Header.Set("If-None-Match", jsblobValidators.etag)
 	}
-	resp, err := clients.http.Do(req)
+	if jsblobValidators.lastModified != "" {
+		req.Header.Set("If-Modified-Since", jsblobValidators.lastModified)
+	}
+
+	// the body is decoded while it's downloaded, so the timeout covers both
+	resp, err := doRequestWith(clients.jsblobHTTP, req)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 	defer resp.Body.Close()
 
-	mu.Lock()
-	defer mu.Unlock()
+	if resp.StatusCode == http.StatusNotModified {
+		slog.Debug("packages.json not modified")
+
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, &HTTPError{StatusCode: resp.StatusCode}
+	}
+
 	slog.Debug("parsing packages.json")
-	if err := json.NewDecoder(brotli.NewReader(resp.Body)).Decode(&jsblob); err != nil {
-		panic(err)
+	var blob map[string]any
+	if err := json.NewDecoder(brotli.NewReader(resp.Body)).Decode(&blob); err != nil {
+		return false, &TransportError{URL: packagesURL, Err: err}
 	}
 
+	mu.Lock()
+	jsblob = blob
+	mu.Unlock()
+
+	jsblobValidators.etag = resp.Header.Get("ETag")
+	jsblobValidators.lastModified = resp.Header.Get("Last-Modified")
+
 	slog.Info("package.json handling completed", "elapsed", time.Since(start))
+
+	return true, nil
 }
 
 // formatPackageList formats a list of package names as markdown list items with backticks